@@ -0,0 +1,170 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrAccessDenied = errors.New("proxyproto source address is denied")
+
+// aclAction action of a prefix in ACL.
+type aclAction byte
+
+const (
+	aclNone aclAction = iota
+	aclAllow
+	aclDeny
+)
+
+// ACL allow and deny CIDR sets of source addresses, the sets can be reloaded while in use.
+// the longest matched prefix decides, deny wins if the same prefix is in both sets.
+// the address not matched is allowed if the allow set is empty, and denied otherwise.
+type ACL struct {
+	sets atomic.Value // *aclSets
+}
+
+type aclSets struct {
+	v4, v6       *prefixNode
+	defaultAllow bool
+}
+
+// NewACL create ACL with allow and deny sets.
+func NewACL(allow, deny []netip.Prefix) *ACL {
+	acl := &ACL{}
+	acl.Update(allow, deny)
+	return acl
+}
+
+// Update replace the allow and deny sets atomically.
+func (acl *ACL) Update(allow, deny []netip.Prefix) {
+	sets := &aclSets{v4: &prefixNode{}, v6: &prefixNode{}, defaultAllow: len(allow) == 0}
+	for _, p := range allow {
+		sets.insert(p, aclAllow)
+	}
+	for _, p := range deny {
+		sets.insert(p, aclDeny)
+	}
+	acl.sets.Store(sets)
+}
+
+// Allowed true if the address is allowed.
+func (acl *ACL) Allowed(addr netip.Addr) bool {
+	sets, _ := acl.sets.Load().(*aclSets)
+	if sets == nil {
+		return true
+	}
+
+	addr = addr.Unmap()
+	var action aclAction
+	if addr.Is4() {
+		ip := addr.As4()
+		action = sets.v4.lookup(ip[:])
+	} else if addr.Is6() {
+		ip := addr.As16()
+		action = sets.v6.lookup(ip[:])
+	}
+	switch action {
+	case aclAllow:
+		return true
+	case aclDeny:
+		return false
+	}
+	return sets.defaultAllow
+}
+
+// allowedAddr true if the address is allowed, addresses other than IP are always allowed.
+func (acl *ACL) allowedAddr(addr net.Addr) bool {
+	ap, ok := netip.AddrFromSlice(addrIP(addr))
+	if !ok {
+		return true
+	}
+	return acl.Allowed(ap)
+}
+
+// addrIP IP of TCP or UDP address, nil for others.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			return a.IP
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			return a.IP
+		}
+	}
+	return nil
+}
+
+func (sets *aclSets) insert(p netip.Prefix, action aclAction) {
+	p = p.Masked()
+	addr, bits := p.Addr(), p.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	if addr.Is4() {
+		sets.v4.insert(addr.AsSlice(), bits, action)
+	} else if addr.Is6() {
+		sets.v6.insert(addr.AsSlice(), bits, action)
+	}
+}
+
+// prefixNode a node of binary trie of prefixes.
+type prefixNode struct {
+	children [2]*prefixNode
+	action   aclAction
+}
+
+func (n *prefixNode) insert(ip []byte, bits int, action aclAction) {
+	for i := 0; i < bits; i++ {
+		b := ip[i/8] >> (7 - i%8) & 1
+		if n.children[b] == nil {
+			n.children[b] = &prefixNode{}
+		}
+		n = n.children[b]
+	}
+	// deny wins if the same prefix is in both sets
+	if n.action != aclDeny {
+		n.action = action
+	}
+}
+
+// lookup action of the longest matched prefix.
+func (n *prefixNode) lookup(ip []byte) aclAction {
+	var action = n.action
+	for i := 0; i < len(ip)*8; i++ {
+		n = n.children[ip[i/8]>>(7-i%8)&1]
+		if n == nil {
+			break
+		}
+		if n.action != aclNone {
+			action = n.action
+		}
+	}
+	return action
+}
+
+// ParsePrefixes parse CIDR prefixes, a bare IP address is taken as a single host prefix.
+func ParsePrefixes(strs ...string) ([]netip.Prefix, error) {
+	var prefixes = make([]netip.Prefix, 0, len(strs))
+	for _, s := range strs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,215 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustParsePrefixes(t testing.TB, strs ...string) []netip.Prefix {
+	prefixes, err := ParsePrefixes(strs...)
+	require.NoError(t, err)
+	return prefixes
+}
+
+func TestACL_Allowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		addrs map[string]bool
+	}{
+		{
+			name: "empty",
+			addrs: map[string]bool{
+				"192.168.0.1": true,
+				"2001:db8::1": true,
+			},
+		}, {
+			name: "deny-only",
+			deny: []string{"192.168.0.0/16", "2001:db8::/32"},
+			addrs: map[string]bool{
+				"192.168.0.1":        false,
+				"10.0.0.1":           true,
+				"::ffff:192.168.0.1": false,
+				"2001:db8::1":        false,
+				"2001:db9::1":        true,
+			},
+		}, {
+			name:  "allow-only",
+			allow: []string{"10.0.0.0/8", "2001:db8::1"},
+			addrs: map[string]bool{
+				"10.1.2.3":    true,
+				"192.168.0.1": false,
+				"2001:db8::1": true,
+				"2001:db8::2": false,
+			},
+		}, {
+			name:  "longest-prefix-wins",
+			allow: []string{"10.0.0.0/8", "10.1.2.0/24"},
+			deny:  []string{"10.1.0.0/16"},
+			addrs: map[string]bool{
+				"10.2.0.1": true,
+				"10.1.0.1": false,
+				"10.1.2.3": true,
+			},
+		}, {
+			name:  "deny-wins-same-prefix",
+			allow: []string{"10.0.0.0/8"},
+			deny:  []string{"10.0.0.0/8"},
+			addrs: map[string]bool{
+				"10.0.0.1": false,
+			},
+		}, {
+			name: "mapped-prefix",
+			deny: []string{"::ffff:10.0.0.0/104"},
+			addrs: map[string]bool{
+				"10.0.0.1":    false,
+				"11.0.0.1":    true,
+				"2001:db8::1": true,
+			},
+		}, {
+			name:  "default-route",
+			allow: []string{"0.0.0.0/0"},
+			deny:  []string{"192.168.0.1"},
+			addrs: map[string]bool{
+				"192.168.0.1": false,
+				"192.168.0.2": true,
+				"2001:db8::1": false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := NewACL(mustParsePrefixes(t, tt.allow...), mustParsePrefixes(t, tt.deny...))
+			for addr, want := range tt.addrs {
+				require.Equal(t, want, acl.Allowed(netip.MustParseAddr(addr)), addr)
+			}
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	got, err := ParsePrefixes("10.0.0.0/8", " 192.168.0.1 ", "2001:db8::/32")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, got)
+
+	_, err = ParsePrefixes("10.0.0.0/33")
+	require.Error(t, err)
+	_, err = ParsePrefixes("example.com")
+	require.Error(t, err)
+}
+
+func TestACL_Update(t *testing.T) {
+	acl := NewACL(nil, mustParsePrefixes(t, "10.0.0.0/8"))
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				acl.Allowed(addr)
+			}
+		}()
+	}
+	acl.Update(nil, mustParsePrefixes(t, "192.168.0.0/16"))
+	wg.Wait()
+	require.True(t, acl.Allowed(addr))
+}
+
+func TestConn_ACL(t *testing.T) {
+	acl := NewACL(nil, mustParsePrefixes(t, "192.168.0.0/16"))
+
+	var postErr error
+	conn := newPipeConn(t, "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\nhello",
+		WithACL(acl), WithPostReadHeader(func(h *Header, err error) { postErr = err }))
+	_, err := conn.Read(make([]byte, 5))
+	require.ErrorIs(t, err, ErrAccessDenied)
+	require.ErrorIs(t, postErr, ErrAccessDenied)
+
+	conn = newPipeConn(t, "PROXY TCP4 10.0.0.2 10.0.0.1 56324 443\r\nhello", WithACL(acl))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	// the address of pipe is not IP
+	conn = newPipeConn(t, "hello", WithACL(acl))
+	require.NoError(t, conn.Err())
+}
+
+func TestListener_ACL(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	acl := NewACL(nil, mustParsePrefixes(t, "192.168.0.0/16"))
+	pln := NewListener(ln, WithACL(acl))
+	defer pln.Close()
+
+	dial := func(src string) net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		_, err = client.Write([]byte("PROXY TCP4 " + src + " 10.0.0.1 56324 443\r\n"))
+		require.NoError(t, err)
+		return client
+	}
+
+	// denied connections are closed, and never accepted
+	denied := dial("192.168.0.1")
+	denied.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+	_, err = denied.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	dial("10.0.0.2")
+	conn, err := pln.Accept()
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2:56324", conn.RemoteAddr().String())
+	conn.Close()
+
+	// reload the sets
+	acl.Update(nil, mustParsePrefixes(t, "10.0.0.0/8"))
+	denied = dial("10.0.0.3")
+	denied.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+	_, err = denied.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	dial("192.168.0.1")
+	conn, err = pln.Accept()
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	conn.Close()
+
+	// Accept returns once the listener is closed
+	go pln.Close()
+	_, err = pln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func BenchmarkACL_Allowed(b *testing.B) {
+	var deny []netip.Prefix
+	for i := 0; i < 50000; i++ {
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], uint32(i)<<8)
+		deny = append(deny, netip.PrefixFrom(netip.AddrFrom4(ip), 24))
+	}
+	acl := NewACL(nil, deny)
+	addr := netip.MustParseAddr("0.0.100.1")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if acl.Allowed(addr) {
+			b.Fatal("must be denied")
+		}
+	}
+}
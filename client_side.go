@@ -1,11 +1,18 @@
 package proxyproto
 
 import (
-	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"io"
 	"math"
 	"net"
+	"net/netip"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -19,145 +26,483 @@ var (
 	ErrUnknownTranProtocol = errors.New("formater unknown transport protocol")
 	ErrInvalidAddress      = errors.New("formater invalid source or destination address")
 	ErrExceedPayloadLength = errors.New("payload's length exceeds uint16 (65535) when TLV will be wrote")
+	ErrUnixNameTooLong     = errors.New("formater unix socket name exceeds 108 bytes")
+	ErrNoHeaderInContext   = errors.New("formater no header is carried by the context")
 )
 
-func formatHeader(h *Header, wantChecksum bool) ([]byte, error) {
-	if h == nil {
-		return nil, errors.New("header instance is nil")
-	}
-	if h.SrcAddr == nil || h.DstAddr == nil {
-		return nil, errors.New("header is not found source and destination address")
+func formatHeader(h *Header, wantChecksum bool, opts ...FormatOption) ([]byte, error) {
+	if err := checkHeaderToFormat(h); err != nil {
+		return nil, err
 	}
 
 	if h.Version == Version1 {
 		return formatV1(h)
 	} else if h.Version == Version2 {
-		return formatV2(h, wantChecksum)
+		return formatV2(h, wantChecksum, opts...)
 	}
 	return nil, ErrUnknownVersion
 }
 
+// appendHeader append the formatted header to dst, the header is not modified.
+// dst is returned as it is if failed.
+func appendHeader(dst []byte, h *Header, wantChecksum bool, opts ...FormatOption) ([]byte, error) {
+	if err := checkHeaderToFormat(h); err != nil {
+		return dst, err
+	}
+
+	var b []byte
+	var err error
+	switch h.Version {
+	case Version1:
+		b, _, err = appendV1(dst, h)
+	case Version2:
+		b, _, _, err = appendV2(dst, h, wantChecksum, mergeFormatOptions(opts...))
+	default:
+		err = ErrUnknownVersion
+	}
+	if err != nil {
+		return dst, err
+	}
+	return b, nil
+}
+
+func checkHeaderToFormat(h *Header) error {
+	if h == nil {
+		return errors.New("header instance is nil")
+	}
+	if h.SrcAddr == nil || h.DstAddr == nil {
+		return errors.New("header is not found source and destination address")
+	}
+	return nil
+}
+
 func formatV1(h *Header) ([]byte, error) {
 	if h.Command == CMD_LOCAL {
 		return v1LocalValue, nil
 	}
 
+	raw, af, err := appendV1(nil, h)
+	if err != nil {
+		return nil, err
+	}
+	h.AddressFamily, h.TransportProtocol = af, SOCK_STREAM
+	h.Raw = raw
+	return h.Raw, nil
+}
+
+// appendV1 append header of version 1 to b.
+func appendV1(b []byte, h *Header) ([]byte, AddressFamily, error) {
+	if h.Command == CMD_LOCAL {
+		return append(b, v1LocalValue...), AF_UNSPEC, nil
+	}
+
 	// version 1 supports tcp only.
 	srcType, srcOK := h.SrcAddr.(*net.TCPAddr)
 	dstType, dstOK := h.DstAddr.(*net.TCPAddr)
 	if (!srcOK && !dstOK) || srcType == nil || dstType == nil {
-		return nil, ErrInvalidAddress
-	}
-	h.TransportProtocol = SOCK_STREAM
-
-	var buf bytes.Buffer
-	buf.Write(v1Prefix)
-
-	if len(srcType.IP.To4()) == net.IPv4len && len(dstType.IP.To4()) == net.IPv4len {
-		buf.WriteString("TCP4 ")
-		buf.WriteString(srcType.IP.To4().String())
-		buf.WriteString(" ")
-		buf.WriteString(dstType.IP.To4().String())
-		buf.WriteString(" ")
-		h.AddressFamily = AF_INET // IPv4
-	} else if len(srcType.IP.To16()) == net.IPv6len && len(dstType.IP.To16()) == net.IPv6len {
-		buf.WriteString("TCP6 ")
-		buf.WriteString(srcType.IP.To16().String())
-		buf.WriteString(" ")
-		buf.WriteString(dstType.IP.To16().String())
-		buf.WriteString(" ")
-		h.AddressFamily = AF_INET6 // IPv6
+		return nil, 0, ErrInvalidAddress
+	}
+
+	var af AddressFamily
+	var srcIP, dstIP netip.Addr
+	b = append(b, v1Prefix...)
+	if src4, dst4 := srcType.IP.To4(), dstType.IP.To4(); len(src4) == net.IPv4len && len(dst4) == net.IPv4len {
+		b = append(b, "TCP4 "...)
+		srcIP, _ = netip.AddrFromSlice(src4)
+		dstIP, _ = netip.AddrFromSlice(dst4)
+		af = AF_INET // IPv4
+	} else if src16, dst16 := srcType.IP.To16(), dstType.IP.To16(); len(src16) == net.IPv6len && len(dst16) == net.IPv6len {
+		b = append(b, "TCP6 "...)
+		srcIP, _ = netip.AddrFromSlice(src16)
+		dstIP, _ = netip.AddrFromSlice(dst16)
+		af = AF_INET6 // IPv6
 	} else {
-		return nil, ErrUnknownAddrFamily
+		return nil, 0, ErrUnknownAddrFamily
 	}
 
-	buf.WriteString(strconv.Itoa(srcType.Port))
-	buf.WriteString(" ")
-	buf.WriteString(strconv.Itoa(dstType.Port))
-	buf.WriteString("\r\n") // the CRLF sequence
-	h.Raw = buf.Bytes()
-	return h.Raw, nil
+	b = srcIP.AppendTo(b)
+	b = append(b, ' ')
+	b = dstIP.AppendTo(b)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(srcType.Port), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(dstType.Port), 10)
+	b = append(b, "\r\n"...) // the CRLF sequence
+	return b, af, nil
 }
 
-func formatV2(h *Header, wantChecksum bool) ([]byte, error) {
+func formatV2(h *Header, wantChecksum bool, opts ...FormatOption) ([]byte, error) {
 	if h.Command == CMD_LOCAL {
 		return v2LocalValue, nil
 	}
 
-	var payloadBuf *bytes.Buffer
-	var payloadLength uint16
-	payloadBuf, payloadLength, h.AddressFamily, h.TransportProtocol = guessAndParseAddrs(h.SrcAddr, h.DstAddr)
-	if payloadBuf == nil {
-		return nil, ErrInvalidAddress
-	}
-	if uint16(payloadBuf.Len()) != payloadLength {
-		return nil, ErrInvalidAddress
+	raw, af, tp, err := appendV2(nil, h, wantChecksum, mergeFormatOptions(opts...))
+	if err != nil {
+		return nil, err
 	}
+	h.AddressFamily, h.TransportProtocol = af, tp
+	h.Raw = raw
+	return h.Raw, nil
+}
 
-	var verAndCmd = byte(Version2<<4) + 1                              // version 2, proxy command
-	var afAndTp = byte(h.AddressFamily<<4) + byte(h.TransportProtocol) // address family and transport protocol
+// appendV2 append header of version 2 to b.
+func appendV2(b []byte, h *Header, wantChecksum bool, o FormatOption) ([]byte, AddressFamily, TransportProtocol, error) {
+	if h.Command == CMD_LOCAL {
+		return append(b, v2LocalValue...), AF_UNSPEC, SOCK_UNSPEC, nil
+	}
 
-	if len(h.TLVs) == 0 && !wantChecksum {
-		h.Raw = make([]byte, 0, 16+payloadLength)
-		h.Raw = append(h.Raw, v2Signature...)
-		h.Raw = append(h.Raw, verAndCmd, afAndTp, byte(payloadLength>>8), byte(payloadLength))
-		h.Raw = append(h.Raw, payloadBuf.Bytes()...)
-		return h.Raw, nil
+	var start = len(b)
+	b = append(b, v2Signature...)
+	b = append(b, byte(Version2<<4)|byte(CMD_PROXY), 0, 0, 0) // version 2, proxy command
+	b, af, tp, err := appendV2Addrs(b, h.SrcAddr, h.DstAddr)
+	if err != nil {
+		return nil, 0, 0, err
 	}
+	b[start+13] = byte(af<<4) | byte(tp) // address family and transport protocol
 
 	for _, tlv := range h.TLVs {
-		data := tlv.Format()
-		if l := len(data); 3 < l && l < math.MaxUint16 {
-			if payloadBuf.Len()+l > math.MaxUint16 {
-				return nil, ErrExceedPayloadLength
+		if l := tlv.formatLength(); 3 < l && l < math.MaxUint16 {
+			if len(b)-start-16+l > math.MaxUint16 {
+				return nil, 0, 0, ErrExceedPayloadLength
 			}
-			payloadBuf.Write(data)
-			payloadLength += uint16(l)
+			b = tlv.AppendFormat(b)
 		}
 	}
 
-	var err error
-	h.Raw, err = formatV2Bytes(verAndCmd, afAndTp, payloadLength, payloadBuf, wantChecksum)
-	return h.Raw, err
-}
-
-func formatV2Bytes(verAndCmd, afAndTp byte, length uint16, payload *bytes.Buffer, wantChecksum bool) ([]byte, error) {
+	var length = len(b) - start - 16
 	if wantChecksum {
-		// ensure payload length is valid
-		if int(length)+7 > math.MaxUint16 {
-			return nil, ErrExceedPayloadLength
-		}
 		length += 7 // CRC-32c TLV: 1+2+4=7 bytes
 	}
-	var appendNOOP bool
-	if int(length)+11 < math.MaxUint16 {
-		length += 11 // NOOP TLV: 1+2+8=11 bytes
-		appendNOOP = true
+	if length > math.MaxUint16 {
+		return nil, 0, 0, ErrExceedPayloadLength
 	}
 
-	var buf = make([]byte, 0, 16+length)
-	buf = append(buf, v2Signature...)
-	buf = append(buf, verAndCmd, afAndTp, byte(length>>8), byte(length))
+	var noopLength = -1
+	if o.padding != paddingDefault || len(h.TLVs) > 0 || wantChecksum {
+		noopLength = v2PaddingLength(16+length, o)
+	}
+	if noopLength >= 0 {
+		if length+3+noopLength <= math.MaxUint16 {
+			length += 3 + noopLength
+		} else if o.padding != paddingDefault {
+			return nil, 0, 0, ErrExceedPayloadLength
+		} else {
+			noopLength = -1 // the default padding is dropped rather than failing
+		}
+	}
+	b[start+14], b[start+15] = byte(length>>8), byte(length)
+
+	var checksumOffset = len(b) + 3
+	if wantChecksum {
+		b = append(b, byte(PP2_TYPE_CRC32C), 0, 4, 0, 0, 0, 0)
+	}
+	if noopLength >= 0 {
+		b = append(b, byte(PP2_TYPE_NOOP), byte(noopLength>>8), byte(noopLength))
+		b = append(b, make([]byte, noopLength)...)
+	}
 
+	// checksum is computed over the whole header, padding included
 	if wantChecksum {
-		raw := make([]byte, 0, 16+length)
-		raw = append(raw, buf...)
-		raw = append(raw, payload.Bytes()...)
-		raw = append(raw, byte(PP2_TYPE_CRC32C), 0, 4, 0, 0, 0, 0)
-		if appendNOOP {
-			noopTLV := NewNoOpTLV(8)
-			raw = append(raw, noopTLV.Format()...)
+		binary.BigEndian.PutUint32(b[checksumOffset:], crc32.Checksum(b[start:], crc32cTab))
+	}
+	return b, af, tp, nil
+}
+
+// v2PaddingLength length of the NOOP value to pad a header of headerLength bytes, -1 if not padded.
+func v2PaddingLength(headerLength int, o FormatOption) int {
+	switch o.padding {
+	case paddingDefault:
+		return 8
+	case paddingFixed:
+		return int(o.paddingSize)
+	case paddingAlign:
+		n := int(o.paddingSize)
+		if n <= 1 || headerLength%n == 0 {
+			return -1
+		}
+		gap := n - headerLength%n
+		for gap < 3 {
+			gap += n
+		}
+		return gap - 3
+	}
+	return -1
+}
+
+// WriteHeaderError failed to write the header, the peer may have got a partial header if N > 0.
+type WriteHeaderError struct {
+	N            int64 // bytes written, the header and payload
+	HeaderLength int   // length of the header
+	Err          error
+}
+
+func (e *WriteHeaderError) Error() string {
+	return "write PROXY header: " + e.Err.Error()
+}
+
+func (e *WriteHeaderError) Unwrap() error {
+	return e.Err
+}
+
+// Partial true if only part of the header was written, the stream must not be used anymore.
+func (e *WriteHeaderError) Partial() bool {
+	return e.N > 0 && e.N < int64(e.HeaderLength)
+}
+
+// WriteHeader write the header to w, and the initial payload if present.
+// Raw is written as it is if not nil, otherwise the header is formatted with options,
+// and the header is not modified. partial writes are retried until finished or failed.
+func WriteHeader(w io.Writer, h *Header, opts ...WriteOption) (int64, error) {
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var raw []byte
+	if h != nil {
+		raw = h.Raw
+	}
+	if raw == nil {
+		var err error
+		raw, err = appendHeader(nil, h, o.wantChecksum, o.format...)
+		if err != nil {
+			return 0, &WriteHeaderError{Err: err}
+		}
+	}
+
+	return writeHeaderRaw(w, raw, o.payload)
+}
+
+// writeHeaderRaw write the formatted header and payload with net.Buffers, retry on partial writes.
+func writeHeaderRaw(w io.Writer, raw, payload []byte) (int64, error) {
+	var bufs = net.Buffers{raw}
+	var remain = int64(len(raw))
+	if len(payload) > 0 {
+		bufs = append(bufs, payload)
+		remain += int64(len(payload))
+	}
+
+	var written int64
+	for written < remain {
+		n, err := bufs.WriteTo(w)
+		written += n
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return written, &WriteHeaderError{N: written, HeaderLength: len(raw), Err: err}
 		}
+	}
+	return written, nil
+}
+
+// defaultFlushDelay the header is sent alone if nothing is written in the delay.
+const defaultFlushDelay = 100 * time.Millisecond
+
+// ClientConn a client side connection, which holds the formatted header,
+// and sends it together with the first write in a single writev if supported.
+// the header is flushed alone before the first read, or once the connection is idle
+// for the flush delay, so that server-speaks-first protocols still work.
+type ClientConn struct {
+	net.Conn
+
+	header       *Header
+	raw          []byte
+	wantChecksum bool
+	format       []FormatOption
+	flushDelay   time.Duration
+
+	mu      sync.Mutex // guards timer and claimed, it is never held while writing
+	timer   *time.Timer
+	claimed bool          // true once a caller began sending the header
+	flushed chan struct{} // closed once the header has been sent, or failed to
+	sent    uint32        // 1 once flushed is closed
+	err     error         // error of sending the header, written before flushed is closed
+}
+
+// NewClientConn format the header, and wrap the connection to send it with the first write.
+// the header is not modified.
+func NewClientConn(conn net.Conn, h *Header, opts ...ClientOption) (*ClientConn, error) {
+	c := &ClientConn{Conn: conn, header: h, flushDelay: defaultFlushDelay, flushed: make(chan struct{})}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	raw, err := appendHeader(nil, h, c.wantChecksum, c.format...)
+	if err != nil {
+		return nil, err
+	}
+	c.raw = raw
+
+	if c.flushDelay > 0 {
+		c.mu.Lock()
+		c.timer = time.AfterFunc(c.flushDelay, func() {
+			if c.claim() {
+				c.send(nil)
+			}
+		})
+		c.mu.Unlock()
+	}
+	return c, nil
+}
+
+// Header the header to send.
+func (c *ClientConn) Header() *Header {
+	return c.header
+}
+
+// Write send the header together with b on the first call.
+// concurrent writes wait for the header, so that nothing is sent before it.
+func (c *ClientConn) Write(b []byte) (int, error) {
+	if atomic.LoadUint32(&c.sent) == 0 {
+		if c.claim() {
+			return c.send(b)
+		}
+		<-c.flushed
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+// Read flush the header before reading.
+func (c *ClientConn) Read(b []byte) (int, error) {
+	if err := c.Flush(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Flush send the header if not yet, or wait for the concurrent sending.
+func (c *ClientConn) Flush() error {
+	if atomic.LoadUint32(&c.sent) == 0 {
+		if c.claim() {
+			c.send(nil)
+		} else {
+			<-c.flushed
+		}
+	}
+	return c.err
+}
 
-		checksumBytes := CalcCRC32cChecksum(raw)
-		// write CRC-32c checksum in payload
-		checksumTLV := NewTLV(PP2_TYPE_CRC32C, checksumBytes)
-		payload.Write(checksumTLV.Format())
+// Close flush the header if nobody began to, and close the connection.
+// it never waits for a blocked sending of the header, closing the connection unblocks it.
+func (c *ClientConn) Close() error {
+	if c.claim() {
+		c.send(nil)
 	}
+	return c.Conn.Close()
+}
+
+// CloseWrite flush the header, and shut down the writing side of the underlying connection.
+func (c *ClientConn) CloseWrite() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrNotSupported
+}
+
+// claim true if the caller is to send the header, only the first caller is.
+func (c *ClientConn) claim() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.claimed {
+		return false
+	}
+	c.claimed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return true
+}
 
-	if appendNOOP {
-		noopTLV := NewNoOpTLV(8)
-		payload.Write(noopTLV.Format())
+// send send the header with payload out of the lock, returns number of payload bytes written.
+// it is called once by the caller who claimed.
+func (c *ClientConn) send(payload []byte) (int, error) {
+	n, err := writeHeaderRaw(c.Conn, c.raw, payload)
+	// the stream is broken if the header is not written completely
+	if n < int64(len(c.raw)) {
+		c.err = err
+	}
+	atomic.StoreUint32(&c.sent, 1)
+	close(c.flushed)
+
+	if n -= int64(len(c.raw)); n < 0 {
+		n = 0
+	}
+	return int(n), err
+}
+
+// ContextDialer dial with context, such as *net.Dialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer dial ClientConn, which sends the header carried by the context of dialing.
+type Dialer struct {
+	// Dialer dial the underlying connection, *net.Dialer by default.
+	Dialer ContextDialer
+	// Options options of ClientConn.
+	Options []ClientOption
+}
+
+type headerContextKey struct{}
+
+// ContextWithHeader carry the header to send by Dialer.
+func ContextWithHeader(ctx context.Context, h *Header) context.Context {
+	return context.WithValue(ctx, headerContextKey{}, h)
+}
+
+// HeaderFromContext the header carried by ContextWithHeader.
+func HeaderFromContext(ctx context.Context) (*Header, bool) {
+	h, ok := ctx.Value(headerContextKey{}).(*Header)
+	return h, ok && h != nil
+}
+
+// Dial dial with context.Background, it fails because no header is carried.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext dial the address, and send the header carried by ctx.
+// the destination address of header is the dialed address if nil, and so are
+// the address family and transport protocol if unspecified.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	h, ok := HeaderFromContext(ctx)
+	if !ok {
+		return nil, ErrNoHeaderInContext
+	}
+
+	var dialer = d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.DstAddr == nil {
+		copied := *h
+		copied.DstAddr = conn.RemoteAddr()
+		// the family is unknown until dialed, see forwardHeader.
+		if copied.Command == CMD_PROXY && copied.AddressFamily == AF_UNSPEC {
+			if copied.AddressFamily, copied.TransportProtocol, err = addrFamilyAndProtocol(copied.SrcAddr, copied.DstAddr); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		h = &copied
+	}
+	cc, err := NewClientConn(conn, h, d.Options...)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	return append(buf, payload.Bytes()...), nil
+	return cc, nil
 }
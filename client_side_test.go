@@ -1,8 +1,15 @@
 package proxyproto
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -126,3 +133,552 @@ func Test_formatV2(t *testing.T) {
 		})
 	}
 }
+
+func Test_formatV2Unix(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		wantTp  TransportProtocol
+		wantNet string
+		wantErr error
+	}{
+		{name: "unix", network: "unix", wantTp: SOCK_STREAM, wantNet: "unix"},
+		{name: "unixpacket", network: "unixpacket", wantTp: SOCK_STREAM, wantNet: "unix"},
+		{name: "unixgram", network: "unixgram", wantTp: SOCK_DGRAM, wantNet: "unixgram"},
+		{name: "unknown-network", network: "tcp", wantErr: ErrUnknownTranProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Header{
+				Version: Version2,
+				Command: CMD_PROXY,
+				SrcAddr: &net.UnixAddr{Net: tt.network, Name: "@client"},
+				DstAddr: &net.UnixAddr{Net: tt.network, Name: "/var/run/app.sock"},
+			}
+			raw, err := formatV2(h, false)
+			if tt.wantErr != nil {
+				require.EqualError(t, err, tt.wantErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, AF_UNIX, h.AddressFamily)
+			require.Equal(t, tt.wantTp, h.TransportProtocol)
+
+			got, err := ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+			require.NoError(t, err)
+			require.Equal(t, &net.UnixAddr{Net: tt.wantNet, Name: "@client"}, got.SrcAddr)
+			require.Equal(t, &net.UnixAddr{Net: tt.wantNet, Name: "/var/run/app.sock"}, got.DstAddr)
+		})
+	}
+
+	t.Run("name-too-long", func(t *testing.T) {
+		h := &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.UnixAddr{Net: "unix", Name: "/" + strings.Repeat("a", 107)},
+			DstAddr: &net.UnixAddr{Net: "unix", Name: "/var/run/app.sock"},
+		}
+		_, err := formatV2(h, false)
+		require.EqualError(t, err, "source: "+ErrUnixNameTooLong.Error())
+	})
+}
+
+func Test_formatV2Padding(t *testing.T) {
+	tests := []struct {
+		name         string
+		tlvs         TLVs
+		wantChecksum bool
+		opts         []FormatOption
+		wantLength   int
+		wantNOOP     int // length of NOOP value, -1 if not padded
+	}{
+		{name: "default-no-tlv", wantLength: 28, wantNOOP: -1},
+		{name: "default-checksum", wantChecksum: true, wantLength: 46, wantNOOP: 8},
+		{name: "none-checksum", wantChecksum: true, opts: []FormatOption{WithPaddingNone()}, wantLength: 35, wantNOOP: -1},
+		{name: "none-tlv", tlvs: TLVs{NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com"))}, opts: []FormatOption{WithPaddingNone()}, wantLength: 42, wantNOOP: -1},
+		{name: "fixed-no-tlv", opts: []FormatOption{WithPaddingFixed(100)}, wantLength: 131, wantNOOP: 100},
+		{name: "fixed-empty", wantChecksum: true, opts: []FormatOption{WithPaddingFixed(0)}, wantLength: 38, wantNOOP: 0},
+		{name: "align-16", opts: []FormatOption{WithPaddingAlign(16)}, wantLength: 32, wantNOOP: 1},
+		{name: "align-small-gap", wantChecksum: true, opts: []FormatOption{WithPaddingAlign(36)}, wantLength: 72, wantNOOP: 34},
+		{name: "align-aligned", opts: []FormatOption{WithPaddingAlign(4)}, wantLength: 28, wantNOOP: -1},
+		{name: "align-512-checksum", tlvs: TLVs{NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com"))}, wantChecksum: true, opts: []FormatOption{WithPaddingAlign(512)}, wantLength: 512, wantNOOP: 512 - 49 - 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Header{
+				Version: Version2,
+				Command: CMD_PROXY,
+				SrcAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345},
+				DstAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 56789},
+				TLVs:    tt.tlvs,
+			}
+			raw, err := formatV2(h, tt.wantChecksum, tt.opts...)
+			require.NoError(t, err)
+			require.Len(t, raw, tt.wantLength)
+
+			got, err := ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+			require.NoError(t, err)
+			require.Equal(t, tt.wantChecksum, got.ChecksumPresent)
+			require.Equal(t, tt.wantChecksum, got.ChecksumVerified)
+
+			var noop = -1
+			for _, tlv := range got.TLVs {
+				if tlv.Type == PP2_TYPE_NOOP {
+					noop = len(tlv.Value)
+				}
+			}
+			require.Equal(t, tt.wantNOOP, noop)
+		})
+	}
+
+	t.Run("exceed-payload-length", func(t *testing.T) {
+		h := &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 56789},
+		}
+		_, err := formatV2(h, false, WithPaddingFixed(65535))
+		require.EqualError(t, err, ErrExceedPayloadLength.Error())
+	})
+}
+
+var appendFormatHeaders = []struct {
+	name         string
+	h            *Header
+	wantChecksum bool
+}{
+	{
+		name: "v1-local",
+		h: &Header{
+			Version: Version1,
+			Command: CMD_LOCAL,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 56789},
+		},
+	}, {
+		name: "v1-tcp4",
+		h: &Header{
+			Version: Version1,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+		},
+	}, {
+		name: "v1-tcp6",
+		h: &Header{
+			Version: Version1,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			DstAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}, {
+		name: "v2-tcp4",
+		h: &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+		},
+	}, {
+		name: "v2-udp6-tlv-checksum",
+		h: &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			DstAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			TLVs: TLVs{
+				NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com")),
+				NewTLV(PP2Type(234), []byte("vcpe-abcdefg-hijklmn-opqrst-uvwxyz")),
+			},
+		},
+		wantChecksum: true,
+	}, {
+		name: "v2-unix",
+		h: &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.UnixAddr{Net: "unix", Name: "@client"},
+			DstAddr: &net.UnixAddr{Net: "unix", Name: "/var/run/app.sock"},
+		},
+	},
+}
+
+func TestHeader_AppendFormat(t *testing.T) {
+	for _, tt := range appendFormatHeaders {
+		t.Run(tt.name, func(t *testing.T) {
+			var before = *tt.h
+			var prefix = []byte("prefix")
+			got, err := appendHeader(prefix, tt.h, tt.wantChecksum)
+			require.NoError(t, err)
+			require.Equal(t, before, *tt.h, "header must not be modified")
+
+			var h = before
+			want, err := formatHeader(&h, tt.wantChecksum)
+			require.NoError(t, err)
+			require.Equal(t, append([]byte("prefix"), want...), got)
+		})
+	}
+
+	t.Run("error-returns-dst", func(t *testing.T) {
+		h := &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345},
+			DstAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 56789},
+		}
+		var dst = []byte("prefix")
+		got, err := h.AppendFormat(dst)
+		require.EqualError(t, err, ErrInvalidAddress.Error())
+		require.Equal(t, dst, got)
+	})
+
+	t.Run("noop-without-value", func(t *testing.T) {
+		tlv := TLV{Type: PP2_TYPE_NOOP, Length: 2}
+		require.Equal(t, []byte{0x04, 0x00, 0x02, 0x00, 0x00}, tlv.Format())
+		require.Equal(t, tlv.Format(), tlv.AppendFormat(nil))
+	})
+}
+
+func TestHeader_AppendFormatAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are instrumented by the race detector")
+	}
+	var buf = make([]byte, 0, 1024)
+	for _, tt := range appendFormatHeaders {
+		t.Run(tt.name, func(t *testing.T) {
+			allocs := testing.AllocsPerRun(100, func() {
+				if _, err := appendHeader(buf[:0], tt.h, tt.wantChecksum); err != nil {
+					t.Fatal(err)
+				}
+			})
+			require.Zero(t, allocs)
+		})
+	}
+
+	t.Run("padding", func(t *testing.T) {
+		h := appendFormatHeaders[4].h
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := h.AppendFormatWithChecksum(buf[:0], WithPaddingAlign(64)); err != nil {
+				t.Fatal(err)
+			}
+		})
+		require.Zero(t, allocs)
+	})
+}
+
+func BenchmarkHeader_Format(b *testing.B) {
+	for _, tt := range appendFormatHeaders {
+		b.Run(tt.name, func(b *testing.B) {
+			var h = *tt.h
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := formatHeader(&h, tt.wantChecksum); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHeader_AppendFormat(b *testing.B) {
+	var buf = make([]byte, 0, 1024)
+	for _, tt := range appendFormatHeaders {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := appendHeader(buf[:0], tt.h, tt.wantChecksum); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// limitedWriter write at most n bytes per call, and fail with err once limit bytes are written.
+type limitedWriter struct {
+	bytes.Buffer
+	n     int
+	limit int
+	err   error
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.err != nil && w.Len() >= w.limit {
+		return 0, w.err
+	}
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriteHeader(t *testing.T) {
+	newHeader := func() *Header {
+		return &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 56789},
+		}
+	}
+	var _ io.WriterTo = newHeader()
+
+	t.Run("format-on-demand", func(t *testing.T) {
+		h := newHeader()
+		var buf bytes.Buffer
+		n, err := h.WriteTo(&buf)
+		require.NoError(t, err)
+		require.Nil(t, h.Raw, "header must not be modified")
+
+		want, err := newHeader().Format()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(want)), n)
+		require.Equal(t, want, buf.Bytes())
+	})
+
+	t.Run("raw-as-it-is", func(t *testing.T) {
+		h := newHeader()
+		h.Raw = []byte("PROXY UNKNOWN\r\n")
+		var buf bytes.Buffer
+		_, err := WriteHeader(&buf, h, WithWriteChecksum())
+		require.NoError(t, err)
+		require.Equal(t, h.Raw, buf.Bytes())
+	})
+
+	t.Run("checksum-and-padding", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := WriteHeader(&buf, newHeader(), WithWriteChecksum(), WithWriteFormat(WithPaddingAlign(64)))
+		require.NoError(t, err)
+		require.Equal(t, 64, buf.Len())
+
+		got, err := ReadHeader(bufio.NewReader(&buf))
+		require.NoError(t, err)
+		require.True(t, got.ChecksumVerified)
+	})
+
+	t.Run("partial-writes", func(t *testing.T) {
+		w := &limitedWriter{n: 1}
+		n, err := WriteHeader(w, newHeader(), WithInitialPayload([]byte("hello")))
+		require.NoError(t, err)
+		require.Equal(t, int64(w.Len()), n)
+		require.True(t, strings.HasSuffix(w.String(), "hello"))
+	})
+
+	t.Run("short-write", func(t *testing.T) {
+		w := &limitedWriter{n: 0}
+		n, err := WriteHeader(w, newHeader())
+		require.Zero(t, n)
+		require.ErrorIs(t, err, io.ErrShortWrite)
+	})
+
+	t.Run("failed-in-header", func(t *testing.T) {
+		w := &limitedWriter{n: 4, limit: 8, err: io.ErrClosedPipe}
+		n, err := WriteHeader(w, newHeader(), WithInitialPayload([]byte("hello")))
+		require.Equal(t, int64(8), n)
+
+		var writeErr *WriteHeaderError
+		require.True(t, errors.As(err, &writeErr))
+		require.True(t, writeErr.Partial())
+		require.Equal(t, 28, writeErr.HeaderLength)
+		require.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+
+	t.Run("failed-in-payload", func(t *testing.T) {
+		w := &limitedWriter{n: 64, limit: 28, err: io.ErrClosedPipe}
+		_, err := WriteHeader(w, newHeader(), WithInitialPayload([]byte("hello")))
+
+		var writeErr *WriteHeaderError
+		require.True(t, errors.As(err, &writeErr))
+		require.False(t, writeErr.Partial())
+		require.Equal(t, int64(28), writeErr.N)
+	})
+
+	t.Run("format-error", func(t *testing.T) {
+		h := newHeader()
+		h.DstAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 56789}
+		var buf bytes.Buffer
+		_, err := WriteHeader(&buf, h)
+		require.ErrorIs(t, err, ErrInvalidAddress)
+		require.Zero(t, buf.Len())
+	})
+
+	t.Run("tcp-coalesced", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		go func() {
+			WriteHeader(client, newHeader(), WithInitialPayload([]byte("hello")))
+			client.Close()
+		}()
+
+		conn := NewConn(server)
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+		require.Equal(t, "127.0.0.1:12345", conn.RemoteAddr().String())
+	})
+}
+
+func newClientHeader() *Header {
+	return &Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+		DstAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+	}
+}
+
+func TestClientConn(t *testing.T) {
+	t.Run("coalesce-first-write", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		cc, err := NewClientConn(client, newClientHeader(), WithFlushDelay(0))
+		require.NoError(t, err)
+
+		n, err := cc.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+
+		// the header and the first write are sent in a single writev
+		var buf = make([]byte, 1024)
+		n, err = server.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, 28+5, n)
+
+		_, err = cc.Write([]byte(" world"))
+		require.NoError(t, err)
+		cc.Close()
+
+		rest, err := io.ReadAll(server)
+		require.NoError(t, err)
+		got, err := ReadHeader(bufio.NewReader(bytes.NewReader(append(buf[:n], rest...))))
+		require.NoError(t, err)
+		require.Equal(t, "192.168.0.1:56324", got.SrcAddr.String())
+	})
+
+	t.Run("flush-before-read", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		cc, err := NewClientConn(client, newClientHeader(), WithFlushDelay(0))
+		require.NoError(t, err)
+
+		// server speaks first once the header is read
+		go func() {
+			conn := NewConn(server, WithReadHeaderTimeout(DefaultReadHeaderTimeout))
+			if conn.Handshake(context.Background()) == nil {
+				conn.Write([]byte("220 ready\r\n"))
+			}
+		}()
+
+		line, err := bufio.NewReader(cc).ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "220 ready\r\n", line)
+	})
+
+	t.Run("flush-on-idle", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		_, err := NewClientConn(client, newClientHeader(), WithFlushDelay(10*time.Millisecond))
+		require.NoError(t, err)
+
+		conn := NewConn(server, WithReadHeaderTimeout(DefaultReadHeaderTimeout))
+		require.NoError(t, conn.Handshake(context.Background()))
+		require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	})
+
+	t.Run("header-failed", func(t *testing.T) {
+		client, _ := newTCPPair(t)
+		cc, err := NewClientConn(client, newClientHeader(), WithFlushDelay(0))
+		require.NoError(t, err)
+		client.Close()
+
+		_, err = cc.Write([]byte("hello"))
+		var writeErr *WriteHeaderError
+		require.True(t, errors.As(err, &writeErr))
+		_, err = cc.Write([]byte("hello"))
+		require.True(t, errors.As(err, &writeErr))
+		require.ErrorIs(t, cc.Flush(), err)
+	})
+
+	t.Run("close-blocked-write", func(t *testing.T) {
+		for _, delay := range []time.Duration{0, time.Millisecond} {
+			// nobody reads the pipe, so that sending the header blocks
+			client, server := net.Pipe()
+			defer server.Close()
+			cc, err := NewClientConn(client, newClientHeader(), WithFlushDelay(delay))
+			require.NoError(t, err)
+
+			written := make(chan error, 1)
+			go func() {
+				_, err := cc.Write([]byte("hello"))
+				written <- err
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			closed := make(chan error, 1)
+			go func() { closed <- cc.Close() }()
+			select {
+			case err := <-closed:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close waits for the blocked write")
+			}
+			require.ErrorIs(t, <-written, io.ErrClosedPipe)
+			require.ErrorIs(t, cc.Flush(), io.ErrClosedPipe)
+		}
+	})
+
+	t.Run("invalid-header", func(t *testing.T) {
+		client, _ := newTCPPair(t)
+		h := newClientHeader()
+		h.DstAddr = &net.UDPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443}
+		_, err := NewClientConn(client, h)
+		require.EqualError(t, err, ErrInvalidAddress.Error())
+	})
+}
+
+func TestDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pln := NewListener(ln)
+	defer pln.Close()
+
+	h := newClientHeader()
+	h.DstAddr = nil
+	var d = &Dialer{Options: []ClientOption{WithClientChecksum(true)}}
+	conn, err := d.DialContext(ContextWithHeader(context.Background(), h), "tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Nil(t, h.DstAddr, "header must not be modified")
+	require.Equal(t, conn.RemoteAddr(), conn.(*ClientConn).Header().DstAddr)
+
+	go conn.Write([]byte("hello"))
+	accepted, err := pln.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+
+	var buf = make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+	require.Equal(t, "192.168.0.1:56324", accepted.RemoteAddr().String())
+	require.Equal(t, ln.Addr().String(), accepted.LocalAddr().String())
+	require.True(t, accepted.(*Conn).Header().ChecksumVerified)
+
+	_, err = d.Dial("tcp", ln.Addr().String())
+	require.EqualError(t, err, ErrNoHeaderInContext.Error())
+}
+
+func TestDialer_UnspecifiedFamily(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// the destination and the family of forwarded headers are unknown until dialed.
+	h, err := forwardHeader(&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, AF_UNSPEC, h.AddressFamily)
+
+	conn, err := (&Dialer{}).DialContext(ContextWithHeader(context.Background(), h), "tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, AF_UNSPEC, h.AddressFamily, "header must not be modified")
+	require.Equal(t, AF_INET, conn.(*ClientConn).Header().AddressFamily)
+	require.Equal(t, SOCK_STREAM, conn.(*ClientConn).Header().TransportProtocol)
+}
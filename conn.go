@@ -2,33 +2,60 @@ package proxyproto
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"io"
 	"net"
+	"os"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"go.uber.org/zap"
 )
 
+// ErrNotSupported the underlying connection does not support the operation.
+var ErrNotSupported = errors.New("operation not supported by the underlying connection")
+
+// aLongTimeAgo a non-zero time in the past, used to interrupt blocked reads immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
 // PostReadHeader will be called after reading Proxy Protocol header.
 type PostReadHeader func(h *Header, err error)
 
+// HealthCheck will be called after reading a LOCAL header, which is sent by health checkers.
+type HealthCheck func(c *Conn)
+
 // Conn wrap net.Conn, want to read and parse Proxy Protocol header, and so on.
 type Conn struct {
 	net.Conn
 
 	reader *bufio.Reader
 
-	Header            *Header
-	readHeaderOnce    sync.Once     // ensure to read header only once
-	readHeaderTimeout time.Duration // maximum time spent reading header
-	originalDeadline  time.Time     // use to reset deadline after reading header
+	header            *Header
+	handshakeMu       sync.Mutex    // guards handshakeStarted and handshakeDone
+	handshakeStarted  bool          // true once a handshake began, header is read only once
+	handshakeDone     chan struct{} // closed once the header is read
+	readHeaderTimeout time.Duration // maximum time spent reading header, no limit if zero
 	readHeaderErr     error
 
-	disableProxyProtocol bool // true if disable proxy protocol
-	checksum             bool // true if check CRC-32c checksum
+	deadlineMu     sync.Mutex // guards the following deadlines
+	readDeadline   time.Time  // read deadline set by user
+	writeDeadline  time.Time  // write deadline set by user
+	headerDeadline time.Time  // read deadline while reading header, zero otherwise
+
+	disableProxyProtocol bool         // true if disable proxy protocol
+	checksumMode         ChecksumMode // how to validate CRC-32c checksum
+	profile              ParseProfile // how strictly the header is parsed
 	postFunc             PostReadHeader
+	healthCheckFunc      HealthCheck
+	acl                  *ACL // allowed source addresses of the real client
+	rateLimiter          *RateLimiter
+	destinations         *Destinations // expected destination addresses of headers
+	listenAddr           net.Addr      // address of the listener which accepted the connection
+	protocol             Protocol      // detected by the first bytes
+	allowedProtocols     uint32        // bit set of allowed protocols, any if zero
 }
 
 func NewConn(conn net.Conn, opts ...Option) *Conn {
@@ -43,71 +70,261 @@ func NewConn(conn net.Conn, opts ...Option) *Conn {
 	return c
 }
 
-// Read implement net.Conn, in order to read Proxy Protocol header
+// Read implement net.Conn, in order to read Proxy Protocol header.
+// it fails with the error of reading header, if any.
 func (c *Conn) Read(b []byte) (int, error) {
-	c.readHeader()
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	// bytes following the header may be buffered, drain them before the connection
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
 	return c.Conn.Read(b)
 }
 
+// WriteTo implements io.WriterTo, so that io.Copy out of the connection keeps the
+// fast paths of the underlying connection, such as splice on Linux.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	n, err := c.writeBuffered(w)
+	if err != nil {
+		return n, err
+	}
+	if dst, ok := w.(*Conn); ok {
+		w = dst.Conn
+	}
+
+	var nn int64
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		nn, err = wt.WriteTo(w)
+	} else {
+		nn, err = io.Copy(w, c.Conn)
+	}
+	return n + nn, err
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy into the connection keeps the
+// fast paths of the underlying connection, such as splice and sendfile on Linux.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if src, ok := r.(*Conn); ok {
+		nn, err := src.writeBuffered(c.Conn)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		r = src.Conn
+	}
+
+	var nn int64
+	var err error
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		nn, err = rf.ReadFrom(r)
+	} else {
+		nn, err = io.Copy(c.Conn, r)
+	}
+	return n + nn, err
+}
+
+// writeBuffered write the bytes buffered while reading header to w.
+func (c *Conn) writeBuffered(w io.Writer) (int64, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	buffered := c.reader.Buffered()
+	if buffered == 0 {
+		return 0, nil
+	}
+	b, err := c.reader.Peek(buffered)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	c.reader.Discard(n)
+	return int64(n), err
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, such as *net.TCPConn.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrNotSupported
+}
+
+// CloseRead shuts down the reading side of the underlying connection, such as *net.TCPConn.
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return ErrNotSupported
+}
+
+// SetKeepAlive see (*net.TCPConn).SetKeepAlive
+func (c *Conn) SetKeepAlive(keepalive bool) error {
+	if tc, ok := c.Conn.(interface{ SetKeepAlive(bool) error }); ok {
+		return tc.SetKeepAlive(keepalive)
+	}
+	return ErrNotSupported
+}
+
+// SetKeepAlivePeriod see (*net.TCPConn).SetKeepAlivePeriod
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if tc, ok := c.Conn.(interface{ SetKeepAlivePeriod(time.Duration) error }); ok {
+		return tc.SetKeepAlivePeriod(d)
+	}
+	return ErrNotSupported
+}
+
+// SetNoDelay see (*net.TCPConn).SetNoDelay
+func (c *Conn) SetNoDelay(noDelay bool) error {
+	if tc, ok := c.Conn.(interface{ SetNoDelay(bool) error }); ok {
+		return tc.SetNoDelay(noDelay)
+	}
+	return ErrNotSupported
+}
+
+// SetLinger see (*net.TCPConn).SetLinger
+func (c *Conn) SetLinger(sec int) error {
+	if tc, ok := c.Conn.(interface{ SetLinger(int) error }); ok {
+		return tc.SetLinger(sec)
+	}
+	return ErrNotSupported
+}
+
+// File see (*net.TCPConn).File
+func (c *Conn) File() (*os.File, error) {
+	if fc, ok := c.Conn.(interface{ File() (*os.File, error) }); ok {
+		return fc.File()
+	}
+	return nil, ErrNotSupported
+}
+
+// SyscallConn implements syscall.Conn.
+// reading from the raw connection bypasses the bytes buffered after the header.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, ErrNotSupported
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
 // LocalAddr implement net.Conn, in order to read Proxy Protocol header
 func (c *Conn) LocalAddr() net.Addr {
-	c.readHeader()
-	if c.Header != nil && c.Header.Command != CMD_LOCAL && c.Header.DstAddr != nil && c.readHeaderErr == nil {
-		return c.Header.DstAddr
+	if h := c.Header(); h != nil && h.Command != CMD_LOCAL && h.DstAddr != nil && c.readHeaderErr == nil {
+		return h.DstAddr
 	}
 	return c.Conn.LocalAddr()
 }
 
 // RemoteAddr implement net.Conn, in order to read Proxy Protocol header
 func (c *Conn) RemoteAddr() net.Addr {
-	c.readHeader()
-	if c.Header != nil && c.Header.Command != CMD_LOCAL && c.Header.SrcAddr != nil && c.readHeaderErr != nil {
-		return c.Header.SrcAddr
+	if h := c.Header(); h != nil && h.Command != CMD_LOCAL && h.SrcAddr != nil && c.readHeaderErr == nil {
+		return h.SrcAddr
 	}
 	return c.Conn.RemoteAddr()
 }
 
 // SetDeadline implement net.Conn, in order to catch deadline
 func (c *Conn) SetDeadline(t time.Time) error {
-	c.originalDeadline = t
-	return c.Conn.SetDeadline(t)
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.readDeadline, c.writeDeadline = t, t
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetReadDeadline(c.effectiveReadDeadline())
 }
 
 // SetReadDeadline implement net.Conn, in order to catch deadline
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	c.originalDeadline = t
-	return c.Conn.SetReadDeadline(t)
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(c.effectiveReadDeadline())
+}
+
+// SetWriteDeadline implement net.Conn, in order to catch deadline
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// effectiveReadDeadline the earlier one of the user's and the header's read deadline.
+// deadlineMu must be held.
+func (c *Conn) effectiveReadDeadline() time.Time {
+	if c.headerDeadline.IsZero() {
+		return c.readDeadline
+	}
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(c.headerDeadline) {
+		return c.readDeadline
+	}
+	return c.headerDeadline
+}
+
+// setHeaderDeadline set the read deadline while reading header, zero to restore the user's.
+func (c *Conn) setHeaderDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.headerDeadline = t
+	return c.Conn.SetReadDeadline(c.effectiveReadDeadline())
+}
+
+// Header get the PROXY header, it will wait for reading header.
+// nil if the header is not present, or failed to read.
+func (c *Conn) Header() *Header {
+	c.readHeader()
+	return c.header
+}
+
+// IsHealthCheck true if the header is LOCAL, it means the connection was
+// established by the proxy itself, such as health checks, rather than relayed.
+func (c *Conn) IsHealthCheck() bool {
+	h := c.Header()
+	return h != nil && h.Command == CMD_LOCAL
+}
+
+// Protocol get the protocol detected by the first bytes, it will wait for reading header.
+// ProtocolUnknown if the PROXY protocol is disabled.
+func (c *Conn) Protocol() Protocol {
+	c.readHeader()
+	return c.protocol
 }
 
 // TLVs get TLVs of pp2
 func (c *Conn) TLVs() TLVs {
-	if c.Header == nil {
+	h := c.Header()
+	if h == nil {
 		return nil
 	}
-	return c.Header.TLVs
+	return h.TLVs
 }
 
 // GetVpceID find VPC endpoint ID in the PROXY header's TLVs.
 // an unregistered PP2Type will be choosen, and the first byte discarded.
 func (c *Conn) GetVpceID() string {
-	if c.Header == nil || len(c.Header.TLVs) == 0 {
-		return ""
-	}
-	for _, tlv := range c.Header.TLVs {
-		if !tlv.IsRegistered() {
-			return string(tlv.Value[1:])
-		}
-	}
-	return ""
+	return c.Header().VpceID()
 }
 
 // GetVpceIDWithType gets VPC endpoint ID with PP2Type from PROXY header.
 // the subtype of 0 returns all values, otherwise the first byte is discarded.
 func (c *Conn) GetVpceIDWithType(typ PP2Type, subType PP2Type) string {
-	if c.Header == nil || len(c.Header.TLVs) == 0 {
+	h := c.Header()
+	if h == nil || len(h.TLVs) == 0 {
 		return ""
 	}
-	for _, tlv := range c.Header.TLVs {
+	for _, tlv := range h.TLVs {
 		if tlv.Type == typ {
 			if subType == 0 {
 				return string(tlv.Value)
@@ -120,65 +337,221 @@ func (c *Conn) GetVpceIDWithType(typ PP2Type, subType PP2Type) string {
 
 // RawHeader get raw header
 func (c *Conn) RawHeader() []byte {
-	if c.Header == nil {
+	h := c.Header()
+	if h == nil {
 		return nil
 	}
-	return c.Header.Raw
+	return h.Raw
 }
 
-// Err read header error
+// Err read header error, it will wait for reading header.
 func (c *Conn) Err() error {
-	return c.readHeaderErr
+	return c.readHeader()
 }
 
 // ZapFields header fields for zap
 func (c *Conn) ZapFields() []zap.Field {
-	if c.Header == nil {
+	h := c.Header()
+	if h == nil {
 		return nil
 	}
-	return c.Header.ZapFields()
+	return h.ZapFields()
 }
 
 // LogrusFields header fields for logrus
 func (c *Conn) LogrusFields() logrus.Fields {
-	if c.Header == nil {
+	h := c.Header()
+	if h == nil {
 		return nil
 	}
-	return c.Header.LogrusFields()
+	return h.LogrusFields()
 }
 
-// readHeader reader header of proxy protocol only once
-func (c *Conn) readHeader() {
-	c.readHeaderOnce.Do(func() {
-		if c.disableProxyProtocol {
-			return
+// Handshake reads the PROXY header if it has not been read yet, it honors the
+// cancellation and deadline of ctx besides the timeout of reading header.
+// most uses of Conn need not call it explicitly, the first Read or accessor will.
+// only the first call reads the header, the later calls wait for it and return its error,
+// or give up with the error of their own ctx once it is done.
+func (c *Conn) Handshake(ctx context.Context) error {
+	c.handshakeMu.Lock()
+	if c.handshakeDone == nil {
+		c.handshakeDone = make(chan struct{})
+	}
+	done := c.handshakeDone
+	if c.handshakeStarted {
+		c.handshakeMu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// the header read meanwhile wins
+			select {
+			case <-done:
+			default:
+				return ctx.Err()
+			}
 		}
+		return c.readHeaderErr
+	}
+	c.handshakeStarted = true
+	c.handshakeMu.Unlock()
+
+	healthCheck := func() bool {
+		defer close(done)
+		return c.handshake(ctx)
+	}()
+	// once done, the hook is free to use the connection
+	if healthCheck && c.healthCheckFunc != nil {
+		c.healthCheckFunc(c)
+	}
+	return c.readHeaderErr
+}
+
+// readHeader reader header of proxy protocol only once
+func (c *Conn) readHeader() error {
+	return c.Handshake(context.Background())
+}
 
-		originalDeadline := c.originalDeadline
-		c.SetReadDeadline(time.Now().Add(c.readHeaderTimeout))
-		defer c.SetReadDeadline(originalDeadline)
+// handshake read and validate header, returns true if it is a health check.
+func (c *Conn) handshake(ctx context.Context) bool {
+	if c.disableProxyProtocol {
+		c.readHeaderErr = c.checkPolicies(nil)
+		return false
+	}
+	if err := ctx.Err(); err != nil {
+		c.readHeaderErr = err
+		return false
+	}
+
+	var deadline time.Time
+	if c.readHeaderTimeout > 0 {
+		deadline = time.Now().Add(c.readHeaderTimeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	c.setHeaderDeadline(deadline)
+	defer c.setHeaderDeadline(time.Time{})
 
-		reader := bufio.NewReader(c.Conn)
-		header, err := ReadHeader(reader)
+	// interrupt the blocked read once ctx is done
+	stop := afterFunc(ctx, func() { c.setHeaderDeadline(aLongTimeAgo) })
+	defer stop()
 
-		if c.postFunc != nil {
-			c.postFunc(header, err)
+	var header *Header
+	var err error
+	c.protocol, err = DetectProtocol(c.reader)
+	if err == nil {
+		if c.protocol == ProtocolPROXYv1 || c.protocol == ProtocolPROXYv2 {
+			header, err = ReadHeaderWithProfile(c.reader, c.profile)
+		} else {
+			err = ErrNoProxyProtocol
+		}
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		} else if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			// the read deadline may fire a little earlier than the context
+			err = context.DeadlineExceeded
 		}
+	}
 
-		if err == nil && header != nil {
-			// validate CRC-32c checksum
-			if c.checksum && !ChecksumCRC32c(header) {
-				c.readHeaderErr = ErrValidateCRC32cChecksum
-				return
-			}
-			c.Header = header
-			return
+	if err == nil || errors.Is(err, ErrNoProxyProtocol) {
+		// validate CRC-32c checksum, the header is required by ChecksumRequire
+		if checksumErr := validateChecksum(header, c.checksumMode); checksumErr != nil {
+			err = checksumErr
 		}
+	}
+	if err == nil || errors.Is(err, ErrNoProxyProtocol) {
+		if policyErr := c.checkPolicies(header); policyErr != nil {
+			err = policyErr
+		}
+	}
+
+	if c.postFunc != nil {
+		c.postFunc(header, err)
+	}
+
+	if err == nil && header != nil {
+		c.header = header
+		return header.Command == CMD_LOCAL
+	}
 
-		// it is not pp1 and pp2 header, ignore.
-		if errors.Is(err, ErrNoProxyProtocol) {
-			return
+	// it is not pp1 and pp2 header, ignore.
+	if errors.Is(err, ErrNoProxyProtocol) {
+		return false
+	}
+	c.readHeaderErr = err
+	return false
+}
+
+// afterFunc call f in its own goroutine once ctx is done, like context.AfterFunc.
+// stop prevents f from being called, and waits for it to return if it has been called,
+// so that nothing outlives stop.
+func afterFunc(ctx context.Context, f func()) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopped, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			f()
+		case <-stopped:
 		}
-		c.readHeaderErr = err
-	})
+	}()
+	return func() {
+		close(stopped)
+		<-exited
+	}
+}
+
+// handshakeBeforeAccept true if policies are enforced on the connection,
+// Listener reads the header before Accept returns, so that violations are never seen.
+func (c *Conn) handshakeBeforeAccept() bool {
+	return c.acl != nil || c.rateLimiter != nil || c.destinations != nil || c.allowedProtocols != 0
+}
+
+// checkPolicies enforce policies once the header is read, the connection is closed if violated.
+func (c *Conn) checkPolicies(header *Header) error {
+	if c.allowedProtocols != 0 && !c.disableProxyProtocol && c.allowedProtocols&(1<<c.protocol) == 0 {
+		c.Conn.Close()
+		return ErrProtocolRejected
+	}
+	if c.acl != nil && !c.acl.allowedAddr(c.sourceAddr(header)) {
+		c.Conn.Close()
+		return ErrAccessDenied
+	}
+	if c.destinations != nil && header != nil && header.Command != CMD_LOCAL &&
+		!c.destinations.match(header.DstAddr, c.localListenAddr()) {
+		c.Conn.Close()
+		return ErrUnexpectedDestination
+	}
+	if c.rateLimiter != nil && !c.rateLimiter.allowAddr(c.sourceAddr(header)) {
+		c.rateLimiter.close(c.Conn)
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// isPolicyViolation true if the connection is closed by policies.
+func isPolicyViolation(err error) bool {
+	return errors.Is(err, ErrAccessDenied) || errors.Is(err, ErrRateLimited) ||
+		errors.Is(err, ErrUnexpectedDestination) || errors.Is(err, ErrProtocolRejected)
+}
+
+// sourceAddr the real client of header, or the peer of the underlying connection.
+func (c *Conn) sourceAddr(header *Header) net.Addr {
+	if header != nil && header.Command != CMD_LOCAL && header.SrcAddr != nil {
+		return header.SrcAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// localListenAddr the address of the listener, or the local address of the underlying connection.
+func (c *Conn) localListenAddr() net.Addr {
+	if c.listenAddr != nil {
+		return c.listenAddr
+	}
+	return c.Conn.LocalAddr()
 }
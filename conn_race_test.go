@@ -0,0 +1,136 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// These tests are meant to be run with -race as well.
+
+var raceHeaderRaw = "\r\n\r\n\x00\r\nQUIT\n" + // version 2 signature
+	"\x21\x11\x00\x13" + // version 2, proxy command, IPv4, TCP, payload length of 19
+	"\x7F\x00\x00\x01\x7F\x00\x00\x01\x30\x39\xDD\xD5" + // 127.0.0.1:12345 -> 127.0.0.1:56789
+	"\xEA\x00\x04\x01vpc" // type:234, length:4, value:"\x01vpc"
+
+func TestConn_ConcurrentAccessors(t *testing.T) {
+	client, server := newTCPPair(t)
+	conn := NewConn(server, WithReadHeaderTimeout(DefaultReadHeaderTimeout))
+
+	// send header slowly, so that accessors wait for reading header
+	go func() {
+		for i := 0; i < len(raceHeaderRaw); i += 7 {
+			end := i + 7
+			if end > len(raceHeaderRaw) {
+				end = len(raceHeaderRaw)
+			}
+			client.Write([]byte(raceHeaderRaw[i:end]))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const workers = 16
+	var wg sync.WaitGroup
+	var headers = make([]*Header, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			deadline := time.Now().Add(time.Minute)
+			switch i % 4 {
+			case 0:
+				conn.SetDeadline(deadline)
+			case 1:
+				conn.SetReadDeadline(deadline)
+			case 2:
+				conn.SetWriteDeadline(deadline)
+			}
+			headers[i] = conn.Header()
+			conn.RemoteAddr()
+			conn.LocalAddr()
+			conn.TLVs()
+			conn.GetVpceID()
+			conn.IsHealthCheck()
+			conn.ZapFields()
+			require.NoError(t, conn.Err())
+		}(i)
+	}
+	wg.Wait()
+
+	require.NotNil(t, headers[0])
+	for _, h := range headers {
+		require.Same(t, headers[0], h)
+	}
+	require.Equal(t, "127.0.0.1:12345", conn.RemoteAddr().String())
+	require.Equal(t, "127.0.0.1:56789", conn.LocalAddr().String())
+	require.Equal(t, "vpc", conn.GetVpceID())
+}
+
+func TestConn_ReadDeadlineDuringHeader(t *testing.T) {
+	client, server := newTCPPair(t)
+	conn := NewConn(server, WithReadHeaderTimeout(time.Minute))
+
+	// the header never completes, an earlier user's deadline wins over the header's
+	client.Write([]byte(raceHeaderRaw[:10]))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.SetReadDeadline(time.Now().Add(-time.Second))
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- conn.Err() }()
+	select {
+	case err := <-done:
+		require.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading header is not interrupted by the read deadline")
+	}
+}
+
+func TestConn_ReadDeadlineRestored(t *testing.T) {
+	client, server := newTCPPair(t)
+	conn := NewConn(server, WithReadHeaderTimeout(time.Minute))
+
+	// set while the header is being read, it must survive restoring deadline
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		client.Write([]byte(raceHeaderRaw))
+	}()
+	require.NotNil(t, conn.Header())
+
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// the header's deadline is not left behind
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	go client.Write([]byte("x"))
+	n, err := conn.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestConn_WriteDeadlineUntouched(t *testing.T) {
+	client, server := newTCPPair(t)
+	conn := NewConn(server, WithReadHeaderTimeout(time.Minute))
+
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	client.Write([]byte(raceHeaderRaw))
+	require.NotNil(t, conn.Header())
+
+	// reading header restores the read deadline only
+	_, err := conn.Write([]byte("x"))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout(), err)
+
+	require.NoError(t, conn.SetWriteDeadline(time.Time{}))
+	_, err = conn.Write([]byte("x"))
+	require.NoError(t, err)
+}
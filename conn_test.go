@@ -0,0 +1,295 @@
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newPipeConn wrap server side of a pipe, client writes raw to it and then closes.
+func newPipeConn(t *testing.T, raw string, opts ...Option) *Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		client.Write([]byte(raw))
+		client.Close()
+	}()
+	return NewConn(server, append([]Option{WithReadHeaderTimeout(DefaultReadHeaderTimeout)}, opts...)...)
+}
+
+func TestConn_LocalWithTLVs(t *testing.T) {
+	var raw = "\r\n\r\n\x00\r\nQUIT\n" + // version 2 signature
+		"\x20\x11\x00\x13" + // version 2, local command, IPv4, TCP, payload length of 19
+		"\x7F\x00\x00\x01\x7F\x00\x00\x01\x30\x39\xDD\xD5" + // addresses are ignored
+		"\x02\x00\x04peer" + // type:PP2_TYPE_AUTHORITY, length:4, value:peer
+		"GET /health HTTP/1.1\r\n\r\n"
+
+	var healthChecks int
+	conn := newPipeConn(t, raw, WithHealthCheck(func(c *Conn) {
+		healthChecks++
+		require.True(t, c.IsHealthCheck())
+	}))
+
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "GET /health HTTP/1.1\r\n\r\n", string(data))
+	require.NoError(t, conn.Err())
+	require.True(t, conn.IsHealthCheck())
+	require.Equal(t, 1, healthChecks)
+	require.Equal(t, TLVs{{Type: PP2_TYPE_AUTHORITY, Length: 4, Value: []byte("peer")}}, conn.TLVs())
+	require.Equal(t, conn.Conn.RemoteAddr(), conn.RemoteAddr())
+}
+
+func TestConn_ProxyNotHealthCheck(t *testing.T) {
+	var raw = "PROXY TCP4 127.0.0.1 127.0.0.1 12345 56789\r\nhello"
+
+	conn := newPipeConn(t, raw, WithHealthCheck(func(c *Conn) {
+		t.Fatal("unexpected health check")
+	}))
+
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.False(t, conn.IsHealthCheck())
+}
+
+func TestConn_RemoteAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string // empty if the address of the underlying connection
+	}{
+		{name: "v1", raw: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", want: "192.168.0.1:56324"},
+		{name: "v1-unknown", raw: "PROXY UNKNOWN\r\n"},
+		{name: "invalid-header", raw: "PROXY TCP4 192.168.0.1\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newPipeConn(t, tt.raw)
+			want := conn.Conn.RemoteAddr().String()
+			if tt.want != "" {
+				want = tt.want
+			}
+			require.Equal(t, want, conn.RemoteAddr().String())
+		})
+	}
+}
+
+// newTCPPair dial a loopback TCP connection, returns both sides.
+func newTCPPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server, err = ln.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestConn_WriteTo(t *testing.T) {
+	client, server := newTCPPair(t)
+	conn := NewConn(server, WithReadHeaderTimeout(DefaultReadHeaderTimeout))
+
+	go func() {
+		client.Write([]byte("PROXY TCP4 127.0.0.1 127.0.0.1 12345 56789\r\nhello "))
+		client.Write([]byte("world"))
+		client.Close()
+	}()
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, conn)
+	require.NoError(t, err)
+	require.Equal(t, int64(len("hello world")), n)
+	require.Equal(t, "hello world", buf.String())
+	require.Equal(t, "127.0.0.1:12345", conn.RemoteAddr().String())
+}
+
+func TestConn_Relay(t *testing.T) {
+	srcClient, srcServer := newTCPPair(t)
+	dstClient, dstServer := newTCPPair(t)
+	src := NewConn(srcServer, WithReadHeaderTimeout(DefaultReadHeaderTimeout))
+	dst := NewConn(dstClient, WithDisableProxyProto(true))
+
+	go func() {
+		srcClient.Write([]byte("PROXY TCP4 127.0.0.1 127.0.0.1 12345 56789\r\nping"))
+		srcClient.Close()
+	}()
+	go func() {
+		io.Copy(dst, src)
+		dst.CloseWrite()
+	}()
+
+	data, err := io.ReadAll(dstServer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+}
+
+func TestConn_ReadFrom(t *testing.T) {
+	client, server := newTCPPair(t)
+	conn := NewConn(server, WithDisableProxyProto(true))
+
+	n, err := conn.ReadFrom(strings.NewReader("pong"))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), n)
+	require.NoError(t, conn.CloseWrite())
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(data))
+}
+
+func TestConn_TCPOptions(t *testing.T) {
+	_, server := newTCPPair(t)
+	conn := NewConn(server)
+
+	require.NoError(t, conn.SetNoDelay(true))
+	require.NoError(t, conn.SetKeepAlive(true))
+	require.NoError(t, conn.SetKeepAlivePeriod(time.Minute))
+	require.NoError(t, conn.SetLinger(0))
+	rawConn, err := conn.SyscallConn()
+	require.NoError(t, err)
+	require.NotNil(t, rawConn)
+	require.Equal(t, server, conn.NetConn())
+
+	client, pipe := net.Pipe()
+	defer client.Close()
+	conn = NewConn(pipe)
+	require.ErrorIs(t, conn.CloseWrite(), ErrNotSupported)
+	require.ErrorIs(t, conn.SetNoDelay(true), ErrNotSupported)
+	_, err = conn.SyscallConn()
+	require.ErrorIs(t, err, ErrNotSupported)
+	_, err = conn.File()
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestConn_Handshake(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		conn := newPipeConn(t, "PROXY TCP4 127.0.0.1 127.0.0.1 12345 56789\r\n")
+		require.NoError(t, conn.Handshake(context.Background()))
+		require.Equal(t, "127.0.0.1:12345", conn.RemoteAddr().String())
+	})
+
+	t.Run("no-timeout-by-default", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		conn := NewConn(server)
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			client.Write([]byte("PROXY TCP4 127.0.0.1 127.0.0.1 12345 56789\r\n"))
+		}()
+		require.NoError(t, conn.Handshake(context.Background()))
+		require.NotNil(t, conn.Header())
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		_, server := newTCPPair(t)
+		conn := NewConn(server)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		require.ErrorIs(t, conn.Handshake(ctx), context.Canceled)
+		// definitive error
+		require.ErrorIs(t, conn.Handshake(context.Background()), context.Canceled)
+		_, err := conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("waiter-deadline", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		conn := NewConn(server)
+		first := make(chan error, 1)
+		go func() { first <- conn.Handshake(context.Background()) }()
+		time.Sleep(10 * time.Millisecond)
+
+		// a later caller gives up with its own deadline, the header is still read
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, conn.Handshake(ctx), context.DeadlineExceeded)
+
+		client.Write([]byte("PROXY TCP4 127.0.0.1 127.0.0.1 12345 56789\r\n"))
+		require.NoError(t, <-first)
+		require.NoError(t, conn.Handshake(ctx))
+		require.Equal(t, "127.0.0.1:12345", conn.RemoteAddr().String())
+	})
+
+	t.Run("deadline-exceeded", func(t *testing.T) {
+		_, server := newTCPPair(t)
+		conn := NewConn(server, WithReadHeaderTimeout(time.Minute))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, conn.Handshake(ctx), context.DeadlineExceeded)
+	})
+
+	t.Run("user-deadline-kept", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		conn := NewConn(server)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(-time.Second)))
+		client.Write([]byte("PROXY TCP4 127.0.0.1 127.0.0.1 12345 56789\r\n"))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		require.ErrorIs(t, conn.Handshake(ctx), os.ErrDeadlineExceeded)
+	})
+
+	t.Run("malformed-header", func(t *testing.T) {
+		conn := newPipeConn(t, "PROXY TCP4 127.0.0.1\r\nhello")
+		require.ErrorIs(t, conn.Handshake(context.Background()), ErrNotFoundAddressOrPort)
+		_, err := conn.Read(make([]byte, 5))
+		require.ErrorIs(t, err, ErrNotFoundAddressOrPort)
+	})
+}
+
+func TestConn_ChecksumMode(t *testing.T) {
+	var stripped = "\r\n\r\n\x00\r\nQUIT\n" +
+		"\x21\x11\x00\x0C" +
+		"\x7F\x00\x00\x01\x7F\x00\x00\x01\x30\x39\xDD\xD5"
+
+	var reported error
+	conn := newPipeConn(t, stripped+"hello",
+		WithChecksumMode(ChecksumRequire),
+		WithPostReadHeader(func(h *Header, err error) { reported = err }),
+	)
+	_, err := conn.Read(make([]byte, 5))
+	require.ErrorIs(t, err, ErrMissingCRC32cChecksum)
+	require.ErrorIs(t, reported, ErrMissingCRC32cChecksum)
+	require.Nil(t, conn.Header())
+
+	// the header is stripped, or its signature is corrupted under the lenient profile
+	for _, raw := range []string{"hello", "\r\n\r\n\x00\r\nQUIx\n" + stripped[12:] + "hello"} {
+		conn = newPipeConn(t, raw, WithChecksumMode(ChecksumRequire), WithParseProfile(ProfileLenient))
+		require.ErrorIs(t, conn.Handshake(context.Background()), ErrMissingCRC32cChecksum)
+		require.ErrorIs(t, conn.Err(), ErrMissingCRC32cChecksum)
+		_, err = conn.Read(make([]byte, 5))
+		require.ErrorIs(t, err, ErrMissingCRC32cChecksum)
+	}
+
+	conn = newPipeConn(t, stripped+"hello", WithCRC32cChecksum(true))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.False(t, conn.Header().ChecksumPresent)
+
+	conn = newPipeConn(t, string(checksumCRC32cRaw), WithChecksumMode(ChecksumRequire))
+	require.NoError(t, conn.Handshake(context.Background()))
+	require.True(t, conn.Header().ChecksumPresent)
+	require.True(t, conn.Header().ChecksumVerified)
+}
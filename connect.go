@@ -0,0 +1,101 @@
+package proxyproto
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConnectHandler HTTP CONNECT front-end, it hijacks the connection, dials the target
+// and sends the PROXY header of the client to it. HTTP/1.x only, as hijacking is required.
+// it is an open proxy to any target by default, restrict clients by WithTunnelAuth and targets by WithTunnelAllow.
+// dialing the target is limited by WithTunnelHandshakeTimeout, the deadlines of http.Server
+// are cleared once the tunnel is established.
+type ConnectHandler struct {
+	tunnel tunnel
+}
+
+// NewConnectHandler create ConnectHandler, serve it by http.Server, whose listener may be
+// a *Listener, so that the real client is sent to targets.
+func NewConnectHandler(opts ...TunnelOption) *ConnectHandler {
+	return &ConnectHandler{tunnel: newTunnel(opts...)}
+}
+
+// ServeHTTP implement http.Handler.
+func (h *ConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		http.Error(w, "invalid target address", http.StatusBadRequest)
+		return
+	}
+	user, ok := h.authenticate(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	if !h.tunnel.allowed(user, r.Host) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// the client connection is required to build the header, so hijack before dialing.
+	client, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the deadlines of server are kept by the hijacked connection, replace them until established
+	ctx, cancel := h.tunnel.handshakeDeadline(r.Context(), client)
+	defer cancel()
+	upstream, err := h.tunnel.dial(ctx, client, user, r.Host)
+	if err != nil {
+		io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		client.Close()
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		upstream.Close()
+		client.Close()
+		return
+	}
+	if err := client.SetDeadline(time.Time{}); err != nil {
+		upstream.Close()
+		client.Close()
+		return
+	}
+	relay(client, rw.Reader, upstream)
+}
+
+// authenticate check Basic Proxy-Authorization, return the username.
+func (h *ConnectHandler) authenticate(r *http.Request) (string, bool) {
+	if h.tunnel.auth == nil {
+		return "", true
+	}
+	const prefix = "Basic "
+	auth := r.Header.Get("Proxy-Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !h.tunnel.auth(user, password) {
+		return "", false
+	}
+	return user, true
+}
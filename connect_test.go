@@ -0,0 +1,135 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectHandler(t *testing.T) {
+	backend := newTunnelBackend(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: NewConnectHandler(
+		WithTunnelAuth(func(user, password string) bool { return user == "alice" && password == "secret" }),
+		WithTunnelAllow(testAllow),
+		WithTunnelUserTLVs(testUserTLVs),
+	)}
+	go srv.Serve(NewListener(ln))
+	defer srv.Close()
+
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	tests := []struct {
+		name       string
+		header     string
+		method     string
+		target     string
+		auth       string
+		wantStatus int
+		wantSrc    string
+	}{
+		{name: "tunnel", method: http.MethodConnect, target: backend, auth: basic, wantStatus: http.StatusOK},
+		{
+			name: "real-client", header: "PROXY TCP4 192.0.2.60 192.0.2.1 56324 3128\r\n",
+			method: http.MethodConnect, target: backend, auth: basic,
+			wantStatus: http.StatusOK, wantSrc: "192.0.2.60:56324",
+		},
+		{name: "no-auth", method: http.MethodConnect, target: backend, wantStatus: http.StatusProxyAuthRequired},
+		{
+			name: "wrong-password", method: http.MethodConnect, target: backend,
+			auth:       "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:guess")),
+			wantStatus: http.StatusProxyAuthRequired,
+		},
+		{name: "get", method: http.MethodGet, target: backend, auth: basic, wantStatus: http.StatusMethodNotAllowed},
+		{name: "no-port", method: http.MethodConnect, target: "localhost", auth: basic, wantStatus: http.StatusBadRequest},
+		{name: "connection-refused", method: http.MethodConnect, target: closedAddr(t), auth: basic, wantStatus: http.StatusBadGateway},
+		{name: "not-allowed", method: http.MethodConnect, target: "192.0.2.1:80", auth: basic, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			uri := tt.target
+			if tt.method != http.MethodConnect {
+				uri = "/"
+			}
+			req := tt.header + tt.method + " " + uri + " HTTP/1.1\r\nHost: " + tt.target + "\r\n"
+			if tt.auth != "" {
+				req += "Proxy-Authorization: " + tt.auth + "\r\n"
+			}
+			_, err = io.WriteString(conn, req+"\r\n")
+			require.NoError(t, err)
+
+			r := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(r, &http.Request{Method: tt.method})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus == http.StatusProxyAuthRequired {
+				require.Equal(t, `Basic realm="proxy"`, resp.Header.Get("Proxy-Authenticate"))
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			src := tt.wantSrc
+			if src == "" {
+				src = conn.LocalAddr().String()
+			}
+			checkTunnel(t, conn, r, src, "alice")
+		})
+	}
+}
+
+func TestConnectHandler_HandshakeTimeout(t *testing.T) {
+	backend := newTunnelBackend(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	handler := NewConnectHandler(WithTunnelHandshakeTimeout(50 * time.Millisecond))
+	blocking := NewConnectHandler(WithTunnelDialer(blockingDialer{}), WithTunnelHandshakeTimeout(50*time.Millisecond))
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == backend {
+			handler.ServeHTTP(w, r)
+		} else {
+			blocking.ServeHTTP(w, r)
+		}
+	})
+	// the deadlines of server are kept by hijacked connections
+	srv := &http.Server{Handler: mux, ReadTimeout: 50 * time.Millisecond, WriteTimeout: 200 * time.Millisecond}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	connect := func(t *testing.T, target string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		require.NoError(t, err)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		return conn, r, resp
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		start := time.Now()
+		_, _, resp := connect(t, "192.0.2.1:80")
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("established", func(t *testing.T) {
+		conn, r, resp := connect(t, backend)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// the deadlines are cleared for the tunnel
+		time.Sleep(250 * time.Millisecond)
+		checkTunnel(t, conn, r, conn.LocalAddr().String(), "")
+	})
+}
@@ -11,72 +11,149 @@ import (
 // This is also known as the Castagnoli CRC32 and which can compute a full 32-bit CRC step in 3 cycles.
 var crc32cTab = crc32.MakeTable(crc32.Castagnoli)
 
-var ErrValidateCRC32cChecksum = errors.New("pp2 failed to validate CRC-32c checksum")
+var (
+	ErrValidateCRC32cChecksum = errors.New("pp2 failed to validate CRC-32c checksum")
+	ErrMissingCRC32cChecksum  = errors.New("pp2 CRC-32c checksum is required but not present")
+)
+
+// ChecksumMode how CRC-32c checksum (PP2_TYPE_CRC32C) of the received header is validated.
+type ChecksumMode byte
+
+const (
+	// ChecksumIgnore does not validate checksum.
+	ChecksumIgnore ChecksumMode = iota
+	// ChecksumVerifyIfPresent validates checksum if the header carries one.
+	ChecksumVerifyIfPresent
+	// ChecksumRequire requires PROXY headers to carry a valid checksum, so that pp1 is rejected,
+	// and so are connections without header, as anyone on the path can strip it.
+	// LOCAL headers have no addresses to trust, they are validated only if carrying one.
+	ChecksumRequire
+)
+
+func (m ChecksumMode) String() string {
+	switch m {
+	case ChecksumIgnore:
+		return "Ignore"
+	case ChecksumVerifyIfPresent:
+		return "VerifyIfPresent"
+	case ChecksumRequire:
+		return "Require"
+	}
+	return Unknown
+}
+
+// validateChecksum validate CRC-32c checksum of header with the mode, h is nil if no header.
+func validateChecksum(h *Header, mode ChecksumMode) error {
+	switch mode {
+	case ChecksumVerifyIfPresent:
+		if h != nil && h.ChecksumPresent && !h.ChecksumVerified {
+			return ErrValidateCRC32cChecksum
+		}
+	case ChecksumRequire:
+		if h == nil || !h.ChecksumPresent && h.Command == CMD_PROXY {
+			return ErrMissingCRC32cChecksum
+		}
+		if h.ChecksumPresent && !h.ChecksumVerified {
+			return ErrValidateCRC32cChecksum
+		}
+	}
+	return nil
+}
 
 // ChecksumCRC32c CRC-32c checksum with header.
-// just do it when the header is valid and contains a CRC-32c checksum.
+// true if the checksum is verified, or not present, see Header.ChecksumPresent to tell them apart.
+// headers read by ReadHeader have been verified while reading, see Header.ChecksumVerified.
 func ChecksumCRC32c(h *Header) bool {
+	present, verified := verifyCRC32c(h)
+	return !present || verified
+}
+
+// verifyCRC32c find CRC-32c checksum in the TLVs of raw header, and verify it.
+func verifyCRC32c(h *Header) (present bool, verified bool) {
 	// does not meet the conditions for verification
-	if h == nil || h.Command != CMD_PROXY || h.Version != Version2 || h.TransportProtocol.String() == Unknown {
-		return true
+	if h == nil || h.Version != Version2 {
+		return false, false
 	}
 
 	// offset is a starting position of the TLV groups.
 	// 12 + 1 + 1 + 2 = 16 bytes.
 	var offset = 16
-	switch h.AddressFamily {
-	case AF_INET:
-		offset += addressLengthIPv4
-	case AF_INET6:
-		offset += addressLengthIPv6
-	case AF_UNIX:
-		offset += addressLengthUnix
-	default:
-		// reject unknown address family
-		return true
+	var addrLen = v2AddressLength(h.AddressFamily)
+	// reject unknown address family, and LOCAL without addresses has no TLVs
+	if addrLen < 0 || len(h.Raw) < offset+addrLen {
+		return false, false
 	}
+	offset += addrLen
 
-	// TLV flow
+	// only TLV headers are walked, bytes are hashed in as few chunks as possible,
+	// which is much faster than hashing TLVs one by one.
+	var digest crc32cDigest
+	var hashed int // h.Raw[:hashed] has been fed to digest
 	var length = len(h.Raw)
-	for offset < length {
+	for offset+3 <= length {
 		t := PP2Type(h.Raw[offset])
-		// move byte over type
-		offset++
+		l := int(binary.BigEndian.Uint16(h.Raw[offset+1 : offset+3]))
+		// move bytes over type and length
+		offset += 3
 
-		// break if offset is overflow
-		if offset+2 > length {
-			break
+		end := offset + l
+		if end > length {
+			end = length
 		}
-		l := int(binary.BigEndian.Uint16(h.Raw[offset : offset+2]))
-		// move bytes over length
-		offset += 2
-
-		// check crc-32c checksum
-		if t == PP2_TYPE_CRC32C {
-			// return if offset is overflow
-			if offset+4 > length {
-				return true
-			}
-			// due to idempotent
-			var val = make([]byte, length)
-			copy(val, h.Raw)
-			// convert to crc-32c checksum
-			recvCRC32cChecksum := binary.BigEndian.Uint32(val[offset : offset+4])
-			//replace the 32 bits of the checksum field in the received PROXY header with all '0's.
-			copy(val[offset:offset+4], []byte{0, 0, 0, 0})
-			// calculate a CRC32c checksum value of the whole PROXY header.
-			calcCRC32cChecksum := crc32.Checksum(val, crc32cTab)
-			// verify that the calculated CRC32c checksum is the same as the received CRC32c checksum.
-			return recvCRC32cChecksum == calcCRC32cChecksum
+		if t == PP2_TYPE_CRC32C && !digest.present {
+			digest.write(h.Raw[hashed:offset])
+			digest.writeChecksum(h.Raw[offset:end])
+			hashed = end
 		}
-
 		// move bytes over values
-		offset += l
+		offset = end
+	}
+	digest.write(h.Raw[hashed:])
+	return digest.result()
+}
+
+// crc32cZeros the checksum field is replaced with zeros while calculating.
+var crc32cZeros = make([]byte, 4)
+
+// crc32cDigest calculate CRC-32c checksum incrementally while the header is consumed,
+// the value of the first PP2_TYPE_CRC32C is taken as the received checksum, and hashed as zeros.
+// methods of nil digest do nothing.
+type crc32cDigest struct {
+	crc       uint32
+	present   bool   // true if PP2_TYPE_CRC32C is found
+	truncated bool   // true if the value of PP2_TYPE_CRC32C is not 4 bytes
+	received  uint32 // the received checksum
+}
+
+func (d *crc32cDigest) write(p []byte) {
+	if d == nil {
+		return
 	}
+	d.crc = crc32.Update(d.crc, crc32cTab, p)
+}
+
+func (d *crc32cDigest) writeChecksum(value []byte) {
+	if d == nil {
+		return
+	}
+	if d.present {
+		d.write(value)
+		return
+	}
+
+	d.present = true
+	if len(value) != 4 {
+		d.truncated = true
+		d.write(value)
+		return
+	}
+	d.received = binary.BigEndian.Uint32(value)
+	d.write(crc32cZeros)
+}
 
-	// does not meet the conditions for verification, because of
-	// the checksum is not provided as part of the PROXY header.
-	return true
+// result whether the checksum is present, and verified.
+func (d *crc32cDigest) result() (present bool, verified bool) {
+	return d.present, d.present && !d.truncated && d.received == d.crc
 }
 
 // CalcCRC32cChecksum calculate a CRC32c checksum value of the whole PROXY header.
@@ -1,7 +1,12 @@
 package proxyproto
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -60,6 +65,19 @@ var checksumCRC32cTests = []struct {
 			}(),
 		},
 		want: false,
+	}, {
+		name: "failure-truncated-crc32c",
+		h: &Header{
+			Version:           Version2,
+			Command:           CMD_PROXY,
+			AddressFamily:     AF_INET,
+			TransportProtocol: SOCK_STREAM,
+			Raw: []byte("\r\n\r\n\x00\r\nQUIT\n" +
+				"\x21\x11\x00\x11" + // payload length of 17
+				"\x7F\x00\x00\x01\x7F\x00\x00\x01\x30\x39\xDD\xD5" +
+				"\x03\x00\x02\x13\x49"), // type:PP2_TYPE_CRC32C, length:2
+		},
+		want: false,
 	},
 }
 
@@ -71,3 +89,173 @@ func TestChecksumCRC32c(t *testing.T) {
 		})
 	}
 }
+
+func Test_validateChecksum(t *testing.T) {
+	var (
+		missing  = &Header{Version: Version2, Command: CMD_PROXY}
+		verified = &Header{Version: Version2, Command: CMD_PROXY, ChecksumPresent: true, ChecksumVerified: true}
+		invalid  = &Header{Version: Version2, Command: CMD_PROXY, ChecksumPresent: true}
+		v1       = &Header{Version: Version1, Command: CMD_PROXY}
+		local    = &Header{Version: Version2, Command: CMD_LOCAL}
+	)
+	tests := []struct {
+		name    string
+		h       *Header
+		mode    ChecksumMode
+		wantErr error
+	}{
+		{name: "ignore-invalid", h: invalid, mode: ChecksumIgnore},
+		{name: "ignore-missing", h: missing, mode: ChecksumIgnore},
+		{name: "ignore-no-header", mode: ChecksumIgnore},
+		{name: "if-present-no-header", mode: ChecksumVerifyIfPresent},
+		{name: "require-no-header", mode: ChecksumRequire, wantErr: ErrMissingCRC32cChecksum},
+		{name: "if-present-verified", h: verified, mode: ChecksumVerifyIfPresent},
+		{name: "if-present-missing", h: missing, mode: ChecksumVerifyIfPresent},
+		{name: "if-present-invalid", h: invalid, mode: ChecksumVerifyIfPresent, wantErr: ErrValidateCRC32cChecksum},
+		{name: "require-verified", h: verified, mode: ChecksumRequire},
+		{name: "require-missing", h: missing, mode: ChecksumRequire, wantErr: ErrMissingCRC32cChecksum},
+		{name: "require-invalid", h: invalid, mode: ChecksumRequire, wantErr: ErrValidateCRC32cChecksum},
+		{name: "require-v1", h: v1, mode: ChecksumRequire, wantErr: ErrMissingCRC32cChecksum},
+		{name: "require-local", h: local, mode: ChecksumRequire},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateChecksum(tt.h, tt.mode)
+			require.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func Test_verifyCRC32c(t *testing.T) {
+	for _, tt := range checksumCRC32cTests {
+		t.Run(tt.name, func(t *testing.T) {
+			present, verified := verifyCRC32c(tt.h)
+			require.Equal(t, tt.h.Raw != nil, present)
+			require.Equal(t, tt.want && present, verified)
+		})
+	}
+}
+
+// checksumCRC32cCopy the former implementation of ChecksumCRC32c, which copies the
+// whole header to zero the checksum field, it is kept as the baseline of benchmarks.
+func checksumCRC32cCopy(h *Header) bool {
+	var offset = 16 + addressLengthIPv4
+	var length = len(h.Raw)
+	for offset < length {
+		t := PP2Type(h.Raw[offset])
+		offset++
+		if offset+2 > length {
+			break
+		}
+		l := int(binary.BigEndian.Uint16(h.Raw[offset : offset+2]))
+		offset += 2
+		if t == PP2_TYPE_CRC32C {
+			if offset+4 > length {
+				return true
+			}
+			var val = make([]byte, length)
+			copy(val, h.Raw)
+			recvCRC32cChecksum := binary.BigEndian.Uint32(val[offset : offset+4])
+			copy(val[offset:offset+4], []byte{0, 0, 0, 0})
+			return recvCRC32cChecksum == crc32.Checksum(val, crc32cTab)
+		}
+		offset += l
+	}
+	return true
+}
+
+func TestChecksumCRC32c_Copy(t *testing.T) {
+	// the baseline agrees with ChecksumCRC32c on IPv4 headers, which it is limited to,
+	// except that it accepted a truncated checksum
+	for _, tt := range checksumCRC32cTests {
+		if tt.h.Raw == nil || tt.h.AddressFamily != AF_INET || tt.name == "failure-truncated-crc32c" {
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, ChecksumCRC32c(tt.h), checksumCRC32cCopy(tt.h))
+		})
+	}
+}
+
+func TestChecksumCRC32c_SinglePass(t *testing.T) {
+	for _, tt := range checksumCRC32cTests {
+		if tt.h.Raw == nil {
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			var digest crc32cDigest
+			// the header streams in byte by byte
+			reader := bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(tt.h.Raw)), 16)
+			_, err := readV2(reader, ProfileLenient, &digest)
+			require.NoError(t, err)
+			present, verified := digest.result()
+			require.True(t, present)
+			require.Equal(t, tt.want, verified)
+		})
+	}
+}
+
+func BenchmarkChecksumCRC32c(b *testing.B) {
+	h := &Header{
+		Version:           Version2,
+		Command:           CMD_PROXY,
+		AddressFamily:     AF_INET,
+		TransportProtocol: SOCK_STREAM,
+		Raw:               checksumCRC32cRaw,
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !checksumCRC32cCopy(h) {
+				b.Fatal("invalid checksum")
+			}
+		}
+	})
+	b.Run("zero-copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !ChecksumCRC32c(h) {
+				b.Fatal("invalid checksum")
+			}
+		}
+	})
+}
+
+func BenchmarkReadHeaderChecksum(b *testing.B) {
+	var reader = bytes.NewReader(checksumCRC32cRaw)
+	var bufReader = bufio.NewReader(reader)
+
+	// the former way: read, parse, and then checksum a copy of the header
+	b.Run("two-pass", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader.Reset(checksumCRC32cRaw)
+			bufReader.Reset(reader)
+			h, err := readV2(bufReader, ProfileLenient, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := parseV2(h); err != nil {
+				b.Fatal(err)
+			}
+			if !checksumCRC32cCopy(h) {
+				b.Fatal("invalid checksum")
+			}
+		}
+	})
+	b.Run("single-pass", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader.Reset(checksumCRC32cRaw)
+			bufReader.Reset(reader)
+			h, err := readAndParseV2(bufReader, ProfileLenient)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !h.ChecksumVerified {
+				b.Fatal("invalid checksum")
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var ErrUnexpectedDestination = errors.New("proxyproto destination address is unexpected")
+
+// Destinations expected destination addresses of headers,
+// the destination is expected if any of them is matched.
+type Destinations struct {
+	// AddrPorts IP:port pairs.
+	AddrPorts []netip.AddrPort
+	// Prefixes IP prefixes of any port.
+	Prefixes []netip.Prefix
+	// Listener the address the listener is bound to, only the port is compared
+	// if it is bound to an unspecified address, such as 0.0.0.0:443.
+	// it is the local address of the connection if the Conn is not accepted by Listener.
+	Listener bool
+}
+
+// match true if dst is expected, listenAddr is the address of the listener.
+func (d *Destinations) match(dst, listenAddr net.Addr) bool {
+	ap, ok := addrPort(dst)
+	if !ok {
+		return false
+	}
+
+	for _, expected := range d.AddrPorts {
+		if ap == netip.AddrPortFrom(expected.Addr().Unmap(), expected.Port()) {
+			return true
+		}
+	}
+	for _, p := range d.Prefixes {
+		if p.Contains(ap.Addr()) || p.Addr().Is4In6() && p.Contains(netip.AddrFrom16(ap.Addr().As16())) {
+			return true
+		}
+	}
+	if d.Listener {
+		if la, ok := addrPort(listenAddr); ok && la.Port() == ap.Port() {
+			return la.Addr().IsUnspecified() || la.Addr() == ap.Addr()
+		}
+	}
+	return false
+}
+
+// addrPort IP:port of TCP or UDP address with IPv4-mapped address unmapped.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	ip, ok := netip.AddrFromSlice(addrIP(addr))
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		port = a.Port
+	case *net.UDPAddr:
+		port = a.Port
+	}
+	return netip.AddrPortFrom(ip.Unmap(), uint16(port)), true
+}
@@ -0,0 +1,107 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestinations_match(t *testing.T) {
+	d := &Destinations{
+		AddrPorts: []netip.AddrPort{
+			netip.MustParseAddrPort("192.0.2.1:443"),
+			netip.MustParseAddrPort("[::ffff:192.0.2.2]:443"),
+			netip.MustParseAddrPort("[2001:db8::1]:443"),
+		},
+		Prefixes: []netip.Prefix{
+			netip.MustParsePrefix("198.51.100.0/24"),
+			netip.MustParsePrefix("::ffff:203.0.113.0/120"),
+		},
+	}
+	tests := []struct {
+		name string
+		dst  net.Addr
+		want bool
+	}{
+		{name: "addr-port", dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, want: true},
+		{name: "addr-other-port", dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}},
+		{name: "mapped-addr-port", dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}, want: true},
+		{name: "ipv6-addr-port", dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, want: true},
+		{name: "ipv6-other-addr", dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{name: "prefix", dst: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 53}, want: true},
+		{name: "mapped-prefix", dst: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 80}, want: true},
+		{name: "other-addr", dst: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}},
+		{name: "unix", dst: &net.UnixAddr{Net: "unix", Name: "/var/run/app.sock"}},
+		{name: "nil", dst: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, d.match(tt.dst, nil))
+		})
+	}
+
+	t.Run("listener", func(t *testing.T) {
+		d := &Destinations{Listener: true}
+		dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+		require.True(t, d.match(dst, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}))
+		require.True(t, d.match(dst, &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}))
+		require.False(t, d.match(dst, &net.TCPAddr{IP: net.IPv6unspecified, Port: 80}))
+		require.False(t, d.match(dst, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}))
+		require.False(t, d.match(dst, nil))
+	})
+}
+
+func TestConn_Destinations(t *testing.T) {
+	opt := WithDestinations(Destinations{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+
+	var postErr error
+	conn := newPipeConn(t, "PROXY TCP4 192.0.2.60 192.0.2.1 56324 443\r\nhello",
+		opt, WithPostReadHeader(func(h *Header, err error) { postErr = err }))
+	_, err := conn.Read(make([]byte, 5))
+	require.ErrorIs(t, err, ErrUnexpectedDestination)
+	require.ErrorIs(t, postErr, ErrUnexpectedDestination)
+
+	conn = newPipeConn(t, "PROXY TCP4 192.0.2.60 10.0.0.1 56324 443\r\nhello", opt)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	// LOCAL has no destination to validate
+	conn = newPipeConn(t, "PROXY UNKNOWN\r\nhello", opt)
+	require.NoError(t, conn.Err())
+}
+
+func TestListener_Destinations(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pln := NewListener(ln, WithDestinations(Destinations{Listener: true}))
+	defer pln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	dial := func(dst, port string) net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		_, err = client.Write([]byte("PROXY TCP4 192.0.2.60 " + dst + " 56324 " + port + "\r\n"))
+		require.NoError(t, err)
+		return client
+	}
+
+	for _, unexpected := range [][2]string{{"127.0.0.2", port}, {"127.0.0.1", "1"}} {
+		client := dial(unexpected[0], unexpected[1])
+		client.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+		_, err = client.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+	}
+
+	dial("127.0.0.1", port)
+	conn, err := pln.Accept()
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:"+port, conn.LocalAddr().String())
+	conn.Close()
+}
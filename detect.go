@@ -0,0 +1,116 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Protocol the class of protocol detected by the first bytes of connection.
+type Protocol byte
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolPROXYv1
+	ProtocolPROXYv2
+	ProtocolTLS   // TLS ClientHello
+	ProtocolHTTP1 // HTTP/1.x request line
+	ProtocolHTTP2 // HTTP/2 connection preface
+)
+
+var ErrProtocolRejected = errors.New("proxyproto protocol is rejected")
+
+var (
+	http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	http1Methods = [][]byte{
+		[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+		[]byte("CONNECT "), []byte("OPTIONS "), []byte("TRACE "), []byte("PATCH "),
+	}
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolPROXYv1:
+		return "PROXYv1"
+	case ProtocolPROXYv2:
+		return "PROXYv2"
+	case ProtocolTLS:
+		return "TLS"
+	case ProtocolHTTP1:
+		return "HTTP/1"
+	case ProtocolHTTP2:
+		return "HTTP/2"
+	}
+	return "unknown"
+}
+
+// DetectProtocol peek the first bytes of reader to classify the protocol, nothing is consumed.
+// it reads no more than needed to tell the classes apart, ProtocolUnknown if none is matched.
+func DetectProtocol(reader *bufio.Reader) (Protocol, error) {
+	for n := 1; ; n++ {
+		if buffered := reader.Buffered(); buffered > n {
+			n = buffered
+		}
+		prefix, err := reader.Peek(n)
+		proto, decided := classifyProtocol(prefix)
+		if decided {
+			return proto, nil
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, bufio.ErrBufferFull) {
+				return ProtocolUnknown, nil
+			}
+			return ProtocolUnknown, err
+		}
+	}
+}
+
+// classifyProtocol classify the prefix, decided is false if more bytes are needed.
+func classifyProtocol(prefix []byte) (proto Protocol, decided bool) {
+	var undecided bool
+	match := func(signature []byte) bool {
+		if len(prefix) >= len(signature) {
+			return bytes.HasPrefix(prefix, signature)
+		}
+		if bytes.HasPrefix(signature, prefix) {
+			undecided = true
+		}
+		return false
+	}
+
+	switch {
+	case match(v1Prefix):
+		return ProtocolPROXYv1, true
+	case match(v2Signature):
+		return ProtocolPROXYv2, true
+	case match(http2Preface):
+		return ProtocolHTTP2, true
+	case isTLSClientHello(prefix, &undecided):
+		return ProtocolTLS, true
+	}
+	for _, method := range http1Methods {
+		if match(method) {
+			return ProtocolHTTP1, true
+		}
+	}
+	return ProtocolUnknown, !undecided
+}
+
+// isTLSClientHello true if prefix is a TLS handshake record of ClientHello,
+// the content type 0x16, version 0x03xx, 2 bytes length and the handshake type 0x01.
+func isTLSClientHello(prefix []byte, undecided *bool) bool {
+	for i, b := range prefix {
+		switch {
+		case i == 0 && b != 0x16,
+			i == 1 && b != 0x03,
+			i == 2 && b > 0x04,
+			i == 5 && b != 0x01:
+			return false
+		case i == 5:
+			return true
+		}
+	}
+	*undecided = true
+	return false
+}
@@ -0,0 +1,157 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var detectProtocolTests = []struct {
+	name string
+	raw  string
+	want Protocol
+}{
+	{name: "pp1", raw: "PROXY TCP4 192.0.2.60 192.0.2.1 56324 443\r\n", want: ProtocolPROXYv1},
+	{name: "pp2", raw: "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c", want: ProtocolPROXYv2},
+	{name: "tls", raw: "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", want: ProtocolTLS},
+	{name: "tls-server-hello", raw: "\x16\x03\x03\x00\x7a\x02\x00\x00\x76"},
+	{name: "http1", raw: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", want: ProtocolHTTP1},
+	{name: "http1-options", raw: "OPTIONS * HTTP/1.1\r\n\r\n", want: ProtocolHTTP1},
+	{name: "http2", raw: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04", want: ProtocolHTTP2},
+	{name: "ssh", raw: "SSH-2.0-OpenSSH_9.6\r\n"},
+	{name: "lowercase-method", raw: "get / HTTP/1.1\r\n\r\n"},
+	{name: "truncated-pp1", raw: "PROXY"},
+	{name: "truncated-pp2", raw: "\r\n\r\n\x00"},
+	{name: "truncated-http2", raw: "PRI * HTTP/2.0"},
+	{name: "empty", raw: ""},
+}
+
+func TestDetectProtocol(t *testing.T) {
+	for _, tt := range detectProtocolTests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.raw))
+			got, err := DetectProtocol(reader)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+
+			// nothing is consumed
+			rest, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, tt.raw, string(rest))
+		})
+	}
+}
+
+func TestDetectProtocol_Incremental(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want Protocol
+	}{
+		{name: "http1", raw: "PUT ", want: ProtocolHTTP1},
+		{name: "tls", raw: "\x16\x03\x01\x02\x00\x01", want: ProtocolTLS},
+		{name: "pp1", raw: "PROXY ", want: ProtocolPROXYv1},
+		{name: "server-first", raw: "\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			// the bytes are written one by one, and no more is sent
+			go func() {
+				for i := range tt.raw {
+					if _, err := client.Write([]byte{tt.raw[i]}); err != nil {
+						return
+					}
+				}
+			}()
+			server.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+			got, err := DetectProtocol(bufio.NewReader(server))
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConn_Protocol(t *testing.T) {
+	for _, tt := range detectProtocolTests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newPipeConn(t, tt.raw)
+			require.Equal(t, tt.want, conn.Protocol())
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		conn := newPipeConn(t, "PROXY TCP4 192.0.2.60 192.0.2.1 56324 443\r\n", WithDisableProxyProto(true))
+		require.Equal(t, ProtocolUnknown, conn.Protocol())
+	})
+}
+
+func TestConn_AllowedProtocols(t *testing.T) {
+	opt := WithAllowedProtocols(ProtocolPROXYv1, ProtocolPROXYv2, ProtocolTLS)
+
+	var postErr error
+	conn := newPipeConn(t, "GET / HTTP/1.1\r\n\r\n", opt, WithPostReadHeader(func(h *Header, err error) { postErr = err }))
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, ErrProtocolRejected)
+	require.ErrorIs(t, postErr, ErrProtocolRejected)
+	require.Equal(t, ProtocolHTTP1, conn.Protocol())
+
+	conn = newPipeConn(t, "\x16\x03\x01\x02\x00\x01", opt)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "\x16\x03\x01\x02\x00\x01", string(data))
+
+	conn = newPipeConn(t, "PROXY TCP4 192.0.2.60 192.0.2.1 56324 443\r\nhello", opt)
+	data, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.NotNil(t, conn.Header())
+}
+
+func TestListener_AllowedProtocols(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pln := NewListener(ln, WithAllowedProtocols(ProtocolPROXYv2))
+	defer pln.Close()
+
+	dial := func(raw string) net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		_, err = client.Write([]byte(raw))
+		require.NoError(t, err)
+		return client
+	}
+
+	rejected := dial("PROXY TCP4 192.0.2.60 192.0.2.1 56324 443\r\n")
+	rejected.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+	_, err = rejected.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	raw, err := (&Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+		DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+	}).Format()
+	require.NoError(t, err)
+	dial(string(raw))
+	conn, err := pln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, ProtocolPROXYv2, conn.(*Conn).Protocol())
+}
+
+func TestProtocol_String(t *testing.T) {
+	require.Equal(t, "PROXYv2", ProtocolPROXYv2.String())
+	require.Equal(t, "HTTP/1", ProtocolHTTP1.String())
+	require.Equal(t, "unknown", Protocol(0xff).String())
+}
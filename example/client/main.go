@@ -25,19 +25,19 @@ func main() {
 		},
 	}
 
-	raw, err := h.FormatWithChecksum()
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:9090", time.Second*5)
 	if err != nil {
 		log.Println("err:", err)
 		return
 	}
+	defer conn.Close()
 
-	conn, err := net.DialTimeout("tcp", "127.0.0.1:9090", time.Second*5)
+	// the header is formatted with checksum, and sent with the request in a single writev
+	_, err = proxyproto.WriteHeader(conn, h,
+		proxyproto.WithWriteChecksum(),
+		proxyproto.WithInitialPayload([]byte("GET / HTTP/1.0\r\n\r\n")),
+	)
 	if err != nil {
-		log.Println("err:", err)
-		return
-	}
-	n, err := h.WriteTo(conn)
-	if err != nil || n != len(raw) {
 		log.Println("write PROXY header to connection fail:", err)
 	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"github.com/fango6/proxyproto"
+)
+
+var path = "/tmp/proxyproto.sock"
+
+func main() {
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyListener := proxyproto.NewListener(ln)
+	for {
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		go serve(conn)
+	}
+}
+
+func serve(conn net.Conn) {
+	defer conn.Close()
+	// the addresses sent by the sidecar, such as "@client" for an abstract socket name
+	log.Println("remote address:", conn.RemoteAddr(), "local address:", conn.LocalAddr())
+}
@@ -0,0 +1,206 @@
+package proxyproto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+)
+
+// maxUniqueIDLength the maximum length of PP2_TYPE_UNIQUE_ID.
+const maxUniqueIDLength = 128
+
+var ErrUniqueIDTooLong = errors.New("formater unique ID exceeds 128 bytes")
+
+// ForwardOption configure how HeaderFromConn builds the header.
+type ForwardOption func(*forwardOptions)
+
+type forwardOptions struct {
+	version        Version
+	tlvTypes       []PP2Type
+	uniqueID       []byte
+	randomUniqueID bool
+}
+
+// WithForwardVersion build header of the version, default is version 2.
+func WithForwardVersion(version Version) ForwardOption {
+	return func(o *forwardOptions) {
+		o.version = version
+	}
+}
+
+// WithForwardTLVs carry over TLVs of the types from the header of *Conn, pp2 only.
+// CRC-32c and NOOP are specific to a hop, so they are never carried over.
+func WithForwardTLVs(types ...PP2Type) ForwardOption {
+	return func(o *forwardOptions) {
+		o.tlvTypes = append(o.tlvTypes, types...)
+	}
+}
+
+// WithUniqueID add the PP2_TYPE_UNIQUE_ID of this hop, which replaces the carried over one, pp2 only.
+func WithUniqueID(id []byte) ForwardOption {
+	return func(o *forwardOptions) {
+		o.uniqueID = id
+	}
+}
+
+// WithRandomUniqueID add a random PP2_TYPE_UNIQUE_ID of 32 hex characters, pp2 only.
+func WithRandomUniqueID() ForwardOption {
+	return func(o *forwardOptions) {
+		o.randomUniqueID = true
+	}
+}
+
+// HeaderFromConn build a PROXY header to forward the connection to the next hop.
+// the real client is used if conn is, or wraps, a *Conn whose header has been parsed,
+// otherwise the socket addresses. address family and transport protocol are guessed from them.
+func HeaderFromConn(conn net.Conn, opts ...ForwardOption) (*Header, error) {
+	var upstream *Header
+	if pc := findConn(conn); pc != nil {
+		if err := pc.readHeader(); err != nil {
+			return nil, err
+		}
+		upstream = pc.Header()
+	}
+	return forwardHeader(conn.RemoteAddr(), conn.LocalAddr(), upstream, opts...)
+}
+
+// forwardHeader build the header of the addresses, TLVs are carried over from upstream if not nil.
+// dst may be nil for tcp, so that Dialer fills it with the dialed address.
+func forwardHeader(src, dst net.Addr, upstream *Header, opts ...ForwardOption) (*Header, error) {
+	var o = forwardOptions{version: Version2}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.version != Version1 && o.version != Version2 {
+		return nil, ErrUnknownVersion
+	}
+
+	var af AddressFamily
+	var tp TransportProtocol
+	if dst != nil {
+		var err error
+		if af, tp, err = addrFamilyAndProtocol(src, dst); err != nil {
+			return nil, err
+		}
+	} else if addr, ok := src.(*net.TCPAddr); ok && addr != nil {
+		// the destination and the family are filled by Dialer once dialed.
+		tp = SOCK_STREAM
+	} else {
+		return nil, ErrInvalidAddress
+	}
+	// version 1 supports tcp only.
+	if o.version == Version1 && (af == AF_UNIX || tp != SOCK_STREAM) {
+		return nil, ErrInvalidAddress
+	}
+
+	h := &Header{
+		Version:           o.version,
+		Command:           CMD_PROXY,
+		AddressFamily:     af,
+		TransportProtocol: tp,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	}
+	if o.version == Version1 {
+		return h, nil
+	}
+
+	if o.randomUniqueID && o.uniqueID == nil {
+		var id [16]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, err
+		}
+		o.uniqueID = []byte(hex.EncodeToString(id[:]))
+	}
+	if len(o.uniqueID) > maxUniqueIDLength {
+		return nil, ErrUniqueIDTooLong
+	}
+
+	if upstream != nil {
+		for _, tlv := range upstream.TLVs {
+			if !o.carries(tlv.Type) {
+				continue
+			}
+			h.TLVs = append(h.TLVs, NewTLV(tlv.Type, append([]byte(nil), tlv.Value...)))
+		}
+	}
+	if len(o.uniqueID) > 0 {
+		h.TLVs = append(h.TLVs, NewTLV(PP2_TYPE_UNIQUE_ID, o.uniqueID))
+	}
+	return h, nil
+}
+
+// carries true if TLV of the type is carried over to the next hop.
+func (o *forwardOptions) carries(t PP2Type) bool {
+	switch t {
+	case PP2_TYPE_CRC32C, PP2_TYPE_NOOP:
+		return false
+	case PP2_TYPE_UNIQUE_ID:
+		if len(o.uniqueID) > 0 {
+			return false
+		}
+	}
+	for _, typ := range o.tlvTypes {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// findConn find *Conn in the chain of connections wrapped with NetConn, such as *tls.Conn.
+func findConn(conn net.Conn) *Conn {
+	for conn != nil {
+		if pc, ok := conn.(*Conn); ok {
+			return pc
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+// addrFamilyAndProtocol guess address family and transport protocol of the addresses.
+func addrFamilyAndProtocol(src, dst net.Addr) (AddressFamily, TransportProtocol, error) {
+	var srcIP, dstIP net.IP
+	var tp TransportProtocol
+
+	switch srcType := src.(type) {
+	case *net.TCPAddr:
+		dstType, ok := dst.(*net.TCPAddr)
+		if !ok || srcType == nil || dstType == nil {
+			return 0, 0, ErrInvalidAddress
+		}
+		srcIP, dstIP, tp = srcType.IP, dstType.IP, SOCK_STREAM
+
+	case *net.UDPAddr:
+		dstType, ok := dst.(*net.UDPAddr)
+		if !ok || srcType == nil || dstType == nil {
+			return 0, 0, ErrInvalidAddress
+		}
+		srcIP, dstIP, tp = srcType.IP, dstType.IP, SOCK_DGRAM
+
+	case *net.UnixAddr:
+		if _, ok := dst.(*net.UnixAddr); !ok || srcType == nil {
+			return 0, 0, ErrInvalidAddress
+		}
+		if tp = unixTransportProtocol(srcType.Net); tp == SOCK_UNSPEC {
+			return 0, 0, ErrUnknownTranProtocol
+		}
+		return AF_UNIX, tp, nil
+
+	default:
+		return 0, 0, ErrInvalidAddress
+	}
+
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		return AF_INET, tp, nil
+	} else if srcIP.To16() != nil && dstIP.To16() != nil {
+		return AF_INET6, tp, nil
+	}
+	return 0, 0, ErrInvalidAddress
+}
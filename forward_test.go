@@ -0,0 +1,167 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderFromConn(t *testing.T) {
+	t.Run("socket-addresses", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		h, err := HeaderFromConn(server)
+		require.NoError(t, err)
+		require.Equal(t, Version2, h.Version)
+		require.Equal(t, CMD_PROXY, h.Command)
+		require.Equal(t, AF_INET, h.AddressFamily)
+		require.Equal(t, SOCK_STREAM, h.TransportProtocol)
+		require.Equal(t, client.LocalAddr(), h.SrcAddr)
+		require.Equal(t, client.RemoteAddr(), h.DstAddr)
+		require.Empty(t, h.TLVs)
+
+		raw, err := h.Format()
+		require.NoError(t, err)
+		got, err := ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+		require.NoError(t, err)
+		require.Equal(t, client.LocalAddr().String(), got.SrcAddr.String())
+	})
+
+	t.Run("real-client-and-tlvs", func(t *testing.T) {
+		var raw = "\r\n\r\n\x00\r\nQUIT\n" +
+			"\x21\x21\x00\x44" + // version 2, proxy, IPv6, TCP, payload length of 68
+			"\x20\x01\x0D\xB8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0D\xB8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\xDC\x04\x01\xBB" +
+			"\x02\x00\x0Bexample.com" + // PP2_TYPE_AUTHORITY
+			"\x05\x00\x03abc" + // PP2_TYPE_UNIQUE_ID
+			"\x04\x00\x02\x00\x00" + // PP2_TYPE_NOOP
+			"\xEA\x00\x04vpce" // custom
+		conn := newPipeConn(t, raw)
+
+		h, err := HeaderFromConn(conn,
+			WithForwardTLVs(PP2_TYPE_AUTHORITY, PP2_TYPE_NOOP, PP2_TYPE_CRC32C, PP2Type(0xEA)),
+			WithUniqueID([]byte("hop-2")),
+		)
+		require.NoError(t, err)
+		require.Equal(t, AF_INET6, h.AddressFamily)
+		require.Equal(t, "[2001:db8::1]:56324", h.SrcAddr.String())
+		require.Equal(t, "[2001:db8::2]:443", h.DstAddr.String())
+		require.Equal(t, TLVs{
+			NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com")),
+			NewTLV(PP2Type(0xEA), []byte("vpce")),
+			NewTLV(PP2_TYPE_UNIQUE_ID, []byte("hop-2")),
+		}, h.TLVs)
+	})
+
+	t.Run("carry-unique-id", func(t *testing.T) {
+		var raw = "\r\n\r\n\x00\r\nQUIT\n" +
+			"\x21\x11\x00\x12" + // version 2, proxy, IPv4, TCP, payload length of 18
+			"\xC0\xA8\x00\x01\xC0\xA8\x00\x0B\xDC\x04\x01\xBB" +
+			"\x05\x00\x03abc" // PP2_TYPE_UNIQUE_ID
+		h, err := HeaderFromConn(newPipeConn(t, raw), WithForwardTLVs(PP2_TYPE_UNIQUE_ID))
+		require.NoError(t, err)
+		require.Equal(t, TLVs{NewTLV(PP2_TYPE_UNIQUE_ID, []byte("abc"))}, h.TLVs)
+	})
+
+	t.Run("random-unique-id", func(t *testing.T) {
+		h, err := HeaderFromConn(newPipeConn(t, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), WithRandomUniqueID())
+		require.NoError(t, err)
+		require.Len(t, h.TLVs, 1)
+		require.Equal(t, PP2_TYPE_UNIQUE_ID, h.TLVs[0].Type)
+		require.Len(t, h.TLVs[0].Value, 32)
+	})
+
+	t.Run("wrapped-by-tls", func(t *testing.T) {
+		conn := newPipeConn(t, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+		h, err := HeaderFromConn(tls.Server(conn, &tls.Config{}), WithForwardVersion(Version1))
+		require.NoError(t, err)
+		require.Equal(t, Version1, h.Version)
+		require.Equal(t, "192.168.0.1:56324", h.SrcAddr.String())
+
+		raw, err := h.Format()
+		require.NoError(t, err)
+		require.Equal(t, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", string(raw))
+	})
+
+	t.Run("v1-udp", func(t *testing.T) {
+		conn := newPipeConn(t, "\r\n\r\n\x00\r\nQUIT\n"+"\x21\x12\x00\x0C"+"\xC0\xA8\x00\x01\xC0\xA8\x00\x0B\xDC\x04\x01\xBB")
+		_, err := HeaderFromConn(conn, WithForwardVersion(Version1))
+		require.EqualError(t, err, ErrInvalidAddress.Error())
+	})
+
+	t.Run("unique-id-too-long", func(t *testing.T) {
+		client, _ := newTCPPair(t)
+		_, err := HeaderFromConn(client, WithUniqueID([]byte(strings.Repeat("a", 129))))
+		require.EqualError(t, err, ErrUniqueIDTooLong.Error())
+	})
+
+	t.Run("pipe-without-header", func(t *testing.T) {
+		_, err := HeaderFromConn(newPipeConn(t, "hello"))
+		require.EqualError(t, err, ErrInvalidAddress.Error())
+	})
+
+	t.Run("header-error", func(t *testing.T) {
+		_, err := HeaderFromConn(newPipeConn(t, "PROXY TCP4 192.168.0.1\r\n"))
+		require.Error(t, err)
+	})
+}
+
+func Test_addrFamilyAndProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     net.Addr
+		dst     net.Addr
+		wantAf  AddressFamily
+		wantTp  TransportProtocol
+		wantErr error
+	}{
+		{
+			name:   "tcp4",
+			src:    &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			dst:    &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+			wantAf: AF_INET, wantTp: SOCK_STREAM,
+		}, {
+			name:   "tcp-mixed-families",
+			src:    &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:    &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+			wantAf: AF_INET6, wantTp: SOCK_STREAM,
+		}, {
+			name:   "udp6",
+			src:    &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:    &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53},
+			wantAf: AF_INET6, wantTp: SOCK_DGRAM,
+		}, {
+			name:   "unixgram",
+			src:    &net.UnixAddr{Net: "unixgram", Name: "@client"},
+			dst:    &net.UnixAddr{Net: "unixgram", Name: "/var/run/app.sock"},
+			wantAf: AF_UNIX, wantTp: SOCK_DGRAM,
+		}, {
+			name:    "mismatched-types",
+			src:     &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			dst:     &net.UDPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+			wantErr: ErrInvalidAddress,
+		}, {
+			name:    "empty-ip",
+			src:     &net.TCPAddr{Port: 56324},
+			dst:     &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+			wantErr: ErrInvalidAddress,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			af, tp, err := addrFamilyAndProtocol(tt.src, tt.dst)
+			if tt.wantErr != nil {
+				require.EqualError(t, err, tt.wantErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAf, af)
+			require.Equal(t, tt.wantTp, tp)
+		})
+	}
+}
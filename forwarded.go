@@ -0,0 +1,366 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrForwardedSyntax    = errors.New("forwarded invalid syntax")
+	ErrForwardedNoAddress = errors.New("forwarded node of for is not an IP address")
+)
+
+// Forwarded build an element of RFC 7239 Forwarded header, such as
+// for="[2001:db8::1]:56324";by="192.0.2.1:443";proto=https;host=example.com
+// proto is present if PP2_TYPE_SSL is, and host if PP2_TYPE_AUTHORITY is.
+func (h *Header) Forwarded() string {
+	var b strings.Builder
+	b.WriteString("for=")
+	b.WriteString(forwardedNode(h.forwardedAddr(h.SrcAddr)))
+	if addr := h.forwardedAddr(h.DstAddr); addr != nil {
+		b.WriteString(";by=")
+		b.WriteString(forwardedNode(addr))
+	}
+	if proto := h.forwardedProto(); proto != "" {
+		b.WriteString(";proto=")
+		b.WriteString(proto)
+	}
+	if host := h.authority(); host != "" {
+		b.WriteString(";host=")
+		b.WriteString(forwardedValue(host))
+	}
+	return b.String()
+}
+
+// XForwardedFor append the source IP to the prior value of X-Forwarded-For.
+// the prior value is returned as it is if source is not an IP address.
+func (h *Header) XForwardedFor(prior string) string {
+	addr := h.forwardedAddr(h.SrcAddr)
+	if addr == nil {
+		return prior
+	}
+	if prior == "" {
+		return addr.IP.String()
+	}
+	return prior + ", " + addr.IP.String()
+}
+
+// SetForwardedHeaders set Forwarded, X-Forwarded-For, X-Real-IP, X-Forwarded-Proto
+// and X-Forwarded-Host of HTTP header from the PROXY header.
+// Forwarded and X-Forwarded-For are appended to the prior values.
+func SetForwardedHeaders(header http.Header, h *Header) {
+	if h == nil {
+		return
+	}
+
+	forwarded := h.Forwarded()
+	if prior := strings.Join(header.Values("Forwarded"), ", "); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	header.Set("Forwarded", forwarded)
+
+	if addr := h.forwardedAddr(h.SrcAddr); addr != nil {
+		header.Set("X-Forwarded-For", h.XForwardedFor(strings.Join(header.Values("X-Forwarded-For"), ", ")))
+		header.Set("X-Real-IP", addr.IP.String())
+	}
+	if proto := h.forwardedProto(); proto != "" {
+		header.Set("X-Forwarded-Proto", proto)
+	}
+	if host := h.authority(); host != "" {
+		header.Set("X-Forwarded-Host", host)
+	}
+}
+
+// ForwardedOption configure how HeaderFromForwarded picks the client among the elements.
+type ForwardedOption func(*forwardedOptions)
+
+type forwardedOptions struct {
+	hops    int
+	proxies []netip.Prefix
+}
+
+// WithTrustedHops the number of trusted proxies in front of the server which append elements,
+// the client is the n-th element from the right, default is 1.
+func WithTrustedHops(n int) ForwardedOption {
+	return func(o *forwardedOptions) {
+		if n > 0 {
+			o.hops = n
+		}
+	}
+}
+
+// WithTrustedProxies the addresses of trusted proxies, the client is the rightmost element
+// whose for= node is not in the prefixes. it takes precedence over WithTrustedHops.
+func WithTrustedProxies(prefixes ...netip.Prefix) ForwardedOption {
+	return func(o *forwardedOptions) {
+		o.proxies = append(o.proxies, prefixes...)
+	}
+}
+
+// HeaderFromForwarded build a pp2 header from a RFC 7239 Forwarded header value.
+// elements are appended by proxies, so that only the rightmost ones are trusted, and the client is
+// picked from the right, see WithTrustedHops and WithTrustedProxies. the leftmost element is taken
+// if there are fewer elements than trusted hops. the for= node of the client must be an IP address.
+// dst is the destination address, such as the local address of the HTTP server,
+// proto=https and host= of the client's element are converted to PP2_TYPE_SSL and PP2_TYPE_AUTHORITY.
+func HeaderFromForwarded(value string, dst net.Addr, opts ...ForwardedOption) (*Header, error) {
+	var o = forwardedOptions{hops: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	elements, err := parseForwarded(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 {
+		return nil, ErrForwardedSyntax
+	}
+	pairs := o.client(elements)
+
+	ap, err := parseForwardedNode(pairs["for"])
+	if err != nil {
+		return nil, err
+	}
+	src := net.TCPAddrFromAddrPort(ap)
+	af, tp, err := addrFamilyAndProtocol(src, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{
+		Version:           Version2,
+		Command:           CMD_PROXY,
+		AddressFamily:     af,
+		TransportProtocol: tp,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	}
+	if host := pairs["host"]; host != "" {
+		h.TLVs = append(h.TLVs, NewTLV(PP2_TYPE_AUTHORITY, []byte(host)))
+	}
+	if strings.EqualFold(pairs["proto"], "https") {
+		h.TLVs = append(h.TLVs, SSL{Client: PP2_CLIENT_SSL}.TLV())
+	}
+	return h, nil
+}
+
+// client the element of the client, walking from the right.
+func (o *forwardedOptions) client(elements []map[string]string) map[string]string {
+	if len(o.proxies) == 0 {
+		if o.hops >= len(elements) {
+			return elements[0]
+		}
+		return elements[len(elements)-o.hops]
+	}
+
+	for i := len(elements) - 1; i > 0; i-- {
+		ap, err := parseForwardedNode(elements[i]["for"])
+		// a node which is not an IP address can not be trusted
+		if err != nil || !o.trusted(ap.Addr()) {
+			return elements[i]
+		}
+	}
+	return elements[0]
+}
+
+// trusted true if the address is of a trusted proxy.
+func (o *forwardedOptions) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range o.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedAddr the address as TCP address, nil if not an IP address or the header is LOCAL.
+func (h *Header) forwardedAddr(addr net.Addr) *net.TCPAddr {
+	if h == nil || h.Command == CMD_LOCAL {
+		return nil
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil && a.IP != nil {
+			return a
+		}
+	case *net.UDPAddr:
+		if a != nil && a.IP != nil {
+			return &net.TCPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+		}
+	}
+	return nil
+}
+
+// forwardedProto https if the client connected over SSL/TLS, http if not, empty if unknown.
+func (h *Header) forwardedProto() string {
+	if h == nil {
+		return ""
+	}
+	tlv, ok := h.TLVs.Find(PP2_TYPE_SSL)
+	if !ok {
+		return ""
+	}
+	ssl, err := ParseSSL(tlv)
+	if err != nil {
+		return ""
+	}
+	if ssl.ClientSSL() {
+		return "https"
+	}
+	return "http"
+}
+
+// authority the value of PP2_TYPE_AUTHORITY.
+func (h *Header) authority() string {
+	if h == nil {
+		return ""
+	}
+	tlv, _ := h.TLVs.Find(PP2_TYPE_AUTHORITY)
+	return string(tlv.Value)
+}
+
+// forwardedNode format a node of RFC 7239, "unknown" if addr is nil.
+func forwardedNode(addr *net.TCPAddr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	ip = ip.Unmap()
+	var node string
+	if ip.Is6() {
+		node = "[" + ip.String() + "]"
+	} else {
+		node = ip.String()
+	}
+	if addr.Port > 0 {
+		node += ":" + strconv.Itoa(addr.Port)
+	}
+	return forwardedValue(node)
+}
+
+// forwardedValue quote the value if it is not a token.
+func forwardedValue(value string) string {
+	for i := 0; i < len(value); i++ {
+		if !isTokenChar(value[i]) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// isTokenChar token characters of RFC 7230.
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// parseForwarded parse a Forwarded header value into elements of lower-cased pairs.
+func parseForwarded(value string) ([]map[string]string, error) {
+	var elements []map[string]string
+	var pairs = map[string]string{}
+	for i := 0; ; {
+		for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+			i++
+		}
+		if i == len(value) {
+			break
+		}
+
+		// key
+		start := i
+		for i < len(value) && isTokenChar(value[i]) {
+			i++
+		}
+		if i == start || i == len(value) || value[i] != '=' {
+			return nil, ErrForwardedSyntax
+		}
+		key := strings.ToLower(value[start:i])
+		i++
+
+		// value of token or quoted-string
+		var val string
+		if i < len(value) && value[i] == '"' {
+			var b strings.Builder
+			for i++; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			if i == len(value) {
+				return nil, ErrForwardedSyntax
+			}
+			i++
+			val = b.String()
+		} else {
+			start = i
+			for i < len(value) && isTokenChar(value[i]) {
+				i++
+			}
+			val = value[start:i]
+		}
+		if _, ok := pairs[key]; ok {
+			return nil, ErrForwardedSyntax
+		}
+		pairs[key] = val
+
+		for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+			i++
+		}
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ';':
+		case ',':
+			elements = append(elements, pairs)
+			pairs = map[string]string{}
+		default:
+			return nil, ErrForwardedSyntax
+		}
+		i++
+	}
+	if len(pairs) > 0 {
+		elements = append(elements, pairs)
+	}
+	return elements, nil
+}
+
+// parseForwardedNode parse a node of IP address with optional port.
+func parseForwardedNode(node string) (netip.AddrPort, error) {
+	if node == "" || strings.EqualFold(node, "unknown") || node[0] == '_' {
+		return netip.AddrPort{}, ErrForwardedNoAddress
+	}
+
+	var host, port = node, ""
+	if node[0] == '[' {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return netip.AddrPort{}, ErrForwardedSyntax
+		}
+		host, port = node[1:end], strings.TrimPrefix(node[end+1:], ":")
+	} else if i := strings.IndexByte(node, ':'); i >= 0 {
+		host, port = node[:i], node[i+1:]
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, ErrForwardedNoAddress
+	}
+	if port == "" || port[0] == '_' {
+		return netip.AddrPortFrom(ip, 0), nil
+	}
+	p, err := parsePort(port, ProfileStrict)
+	if err != nil {
+		return netip.AddrPort{}, ErrForwardedSyntax
+	}
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
@@ -0,0 +1,233 @@
+package proxyproto
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeader_Forwarded(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       *Header
+		want    string
+		wantXFF string
+	}{
+		{
+			name: "tcp4",
+			h: &Header{
+				Version: Version2,
+				Command: CMD_PROXY,
+				SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+			},
+			want:    `for="192.0.2.60:56324";by="192.0.2.1:443"`,
+			wantXFF: "10.0.0.1, 192.0.2.60",
+		}, {
+			name: "tcp6-https-host",
+			h: &Header{
+				Version: Version2,
+				Command: CMD_PROXY,
+				SrcAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2")},
+				TLVs: TLVs{
+					NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com:8443")),
+					SSL{Client: PP2_CLIENT_SSL}.TLV(),
+				},
+			},
+			want:    `for="[2001:db8::1]:56324";by="[2001:db8::2]";proto=https;host="example.com:8443"`,
+			wantXFF: "10.0.0.1, 2001:db8::1",
+		}, {
+			name: "plain-http",
+			h: &Header{
+				Version: Version2,
+				Command: CMD_PROXY,
+				SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60)},
+				DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)},
+				TLVs:    TLVs{SSL{}.TLV(), NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com"))},
+			},
+			want:    `for=192.0.2.60;by=192.0.2.1;proto=http;host=example.com`,
+			wantXFF: "10.0.0.1, 192.0.2.60",
+		}, {
+			name: "local",
+			h: &Header{
+				Version: Version2,
+				Command: CMD_LOCAL,
+				SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+			},
+			want:    `for=unknown`,
+			wantXFF: "10.0.0.1",
+		}, {
+			name: "unix",
+			h: &Header{
+				Version: Version2,
+				Command: CMD_PROXY,
+				SrcAddr: &net.UnixAddr{Net: "unix", Name: "@client"},
+				DstAddr: &net.UnixAddr{Net: "unix", Name: "/var/run/app.sock"},
+			},
+			want:    `for=unknown`,
+			wantXFF: "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.h.Forwarded())
+			require.Equal(t, tt.wantXFF, tt.h.XForwardedFor("10.0.0.1"))
+		})
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	h := &Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+		DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+		TLVs:    TLVs{NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com")), SSL{Client: PP2_CLIENT_SSL}.TLV()},
+	}
+	header := http.Header{}
+	header.Add("Forwarded", "for=10.0.0.1")
+	header.Add("X-Forwarded-For", "10.0.0.1")
+	header.Add("X-Forwarded-For", "10.0.0.2")
+
+	SetForwardedHeaders(header, h)
+	require.Equal(t, `for=10.0.0.1, for="192.0.2.60:56324";by="192.0.2.1:443";proto=https;host=example.com`, header.Get("Forwarded"))
+	require.Equal(t, "10.0.0.1, 10.0.0.2, 192.0.2.60", header.Get("X-Forwarded-For"))
+	require.Equal(t, "192.0.2.60", header.Get("X-Real-IP"))
+	require.Equal(t, "https", header.Get("X-Forwarded-Proto"))
+	require.Equal(t, "example.com", header.Get("X-Forwarded-Host"))
+}
+
+func TestHeaderFromForwarded(t *testing.T) {
+	var dst = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	tests := []struct {
+		name     string
+		value    string
+		wantSrc  string
+		wantAf   AddressFamily
+		wantTLVs TLVs
+		wantErr  error
+	}{
+		{
+			name:    "ipv4",
+			value:   "for=192.0.2.60",
+			wantSrc: "192.0.2.60:0",
+			wantAf:  AF_INET,
+		}, {
+			name:    "ipv6-port-case-insensitive",
+			value:   `For="[2001:db8:cafe::17]:4711"`,
+			wantSrc: "[2001:db8:cafe::17]:4711",
+			wantAf:  AF_INET6,
+		}, {
+			name:    "proto-host",
+			value:   `for=192.0.2.43;proto=https;host="example.com:8443";by=203.0.113.43`,
+			wantSrc: "192.0.2.43:0",
+			wantAf:  AF_INET,
+			wantTLVs: TLVs{
+				NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com:8443")),
+				SSL{Client: PP2_CLIENT_SSL}.TLV(),
+			},
+		}, {
+			name:     "rightmost-element",
+			value:    `for="192.0.2.43:1234", for=198.51.100.17;proto=https`,
+			wantSrc:  "198.51.100.17:0",
+			wantAf:   AF_INET,
+			wantTLVs: TLVs{SSL{Client: PP2_CLIENT_SSL}.TLV()},
+		}, {
+			name:    "obfuscated-port",
+			value:   `for="192.0.2.43:_hidden"`,
+			wantSrc: "192.0.2.43:0",
+			wantAf:  AF_INET,
+		}, {
+			name:    "unknown",
+			value:   "for=unknown",
+			wantErr: ErrForwardedNoAddress,
+		}, {
+			name:    "obfuscated",
+			value:   "for=192.0.2.43, for=_hidden",
+			wantErr: ErrForwardedNoAddress,
+		}, {
+			name:    "missing-for",
+			value:   "proto=https",
+			wantErr: ErrForwardedNoAddress,
+		}, {
+			name:    "unterminated-quote",
+			value:   `for="192.0.2.43`,
+			wantErr: ErrForwardedSyntax,
+		}, {
+			name:    "duplicated-pair",
+			value:   `for=192.0.2.43;for=192.0.2.44`,
+			wantErr: ErrForwardedSyntax,
+		}, {
+			name:    "empty",
+			value:   "",
+			wantErr: ErrForwardedSyntax,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := HeaderFromForwarded(tt.value, dst)
+			if tt.wantErr != nil {
+				require.EqualError(t, err, tt.wantErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSrc, h.SrcAddr.String())
+			require.Equal(t, dst, h.DstAddr)
+			require.Equal(t, tt.wantAf, h.AddressFamily)
+			require.Equal(t, tt.wantTLVs, h.TLVs)
+
+			_, err = h.Format()
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		// the client prepends a forged element, the proxies append theirs
+		const value = "for=203.0.113.66, for=192.0.2.43, for=10.0.0.2, for=10.0.0.3"
+		trusted := []struct {
+			name string
+			opts []ForwardedOption
+			want string
+		}{
+			{name: "default", want: "10.0.0.3:0"},
+			{name: "hops", opts: []ForwardedOption{WithTrustedHops(3)}, want: "192.0.2.43:0"},
+			{name: "hops-beyond", opts: []ForwardedOption{WithTrustedHops(10)}, want: "203.0.113.66:0"},
+			{name: "proxies", opts: []ForwardedOption{WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8"))}, want: "192.0.2.43:0"},
+			{
+				name: "proxies-over-hops",
+				opts: []ForwardedOption{WithTrustedHops(1), WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8"))},
+				want: "192.0.2.43:0",
+			},
+		}
+		for _, tt := range trusted {
+			t.Run(tt.name, func(t *testing.T) {
+				h, err := HeaderFromForwarded(value, dst, tt.opts...)
+				require.NoError(t, err)
+				require.Equal(t, tt.want, h.SrcAddr.String())
+			})
+		}
+
+		_, err := HeaderFromForwarded("for=192.0.2.43, for=_hidden, for=10.0.0.2", dst,
+			WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")))
+		require.EqualError(t, err, ErrForwardedNoAddress.Error())
+	})
+
+	t.Run("forged", func(t *testing.T) {
+		// a client sends a Forwarded header of its own, the proxy appends the real one
+		h, err := HeaderFromForwarded("for=127.0.0.1;proto=https, for=192.0.2.43", dst)
+		require.NoError(t, err)
+		require.Equal(t, "192.0.2.43:0", h.SrcAddr.String())
+		require.Empty(t, h.TLVs)
+	})
+
+	t.Run("round-trip", func(t *testing.T) {
+		h, err := HeaderFromForwarded(`for="[2001:db8::1]:56324";proto=https;host=example.com`, dst)
+		require.NoError(t, err)
+		require.Equal(t, `for="[2001:db8::1]:56324";by="192.0.2.1:443";proto=https;host=example.com`, h.Forwarded())
+	})
+}
@@ -0,0 +1,93 @@
+// Package grpcproxy integrates the PROXY protocol with gRPC, servers see the real client
+// in peer.Peer.Addr and the header in interceptors, and clients send a header when dialing.
+package grpcproxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/fango6/proxyproto"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// the default of grpc.ConnectionTimeout, gRPC passes no ctx to the handshake,
+	// and its deadline of the connection is replaced while reading header.
+	defaultHandshakeTimeout = time.Second * 120
+)
+
+// AuthInfo the AuthInfo of the wrapped credentials, with the PROXY header.
+// UnaryServerInterceptor and StreamServerInterceptor replace it by the wrapped one in peer.Peer,
+// so that handlers assert such as credentials.TLSInfo as usual, others get it by Unwrap.
+type AuthInfo struct {
+	credentials.AuthInfo
+
+	// Header nil if the PROXY protocol is not used by the connection.
+	Header *proxyproto.Header
+}
+
+// GetCommonAuthInfo the CommonAuthInfo of the wrapped credentials, so that the security level is kept.
+func (a AuthInfo) GetCommonAuthInfo() credentials.CommonAuthInfo {
+	if ci, ok := a.AuthInfo.(interface {
+		GetCommonAuthInfo() credentials.CommonAuthInfo
+	}); ok {
+		return ci.GetCommonAuthInfo()
+	}
+	return credentials.CommonAuthInfo{}
+}
+
+// Unwrap get the AuthInfo of the wrapped credentials.
+func (a AuthInfo) Unwrap() credentials.AuthInfo {
+	return a.AuthInfo
+}
+
+type proxyCredentials struct {
+	credentials.TransportCredentials
+	options []proxyproto.Option
+}
+
+// NewCredentials wrap the server transport credentials to read the PROXY header before their handshake,
+// insecure credentials are wrapped if creds is nil. opts are applied to proxyproto.Conn,
+// the timeout of reading header is proxyproto.DefaultReadHeaderTimeout by default as proxyproto.Listener.
+// RemoteAddr of the connection is the real client, and AuthInfo of peer.Peer is AuthInfo.
+// the header and the handshake of creds are bounded by 120 seconds, the default of grpc.ConnectionTimeout.
+// the connections accepted by proxyproto.Listener are not wrapped again, opts are ignored then.
+func NewCredentials(creds credentials.TransportCredentials, opts ...proxyproto.Option) credentials.TransportCredentials {
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	return &proxyCredentials{TransportCredentials: creds, options: opts}
+}
+
+func (c *proxyCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	pc, ok := rawConn.(*proxyproto.Conn)
+	if !ok {
+		opts := append([]proxyproto.Option{proxyproto.WithReadHeaderTimeout(proxyproto.DefaultReadHeaderTimeout)}, c.options...)
+		pc = proxyproto.NewConn(rawConn, opts...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHandshakeTimeout)
+	defer cancel()
+	if err := pc.Handshake(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	// the deadline of the connection is cleared once the header is read, set it again for creds
+	deadline, _ := ctx.Deadline()
+	if err := pc.SetDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+	conn, info, err := c.TransportCredentials.ServerHandshake(pc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pc.SetDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	return conn, AuthInfo{AuthInfo: info, Header: pc.Header()}, nil
+}
+
+func (c *proxyCredentials) Clone() credentials.TransportCredentials {
+	return &proxyCredentials{TransportCredentials: c.TransportCredentials.Clone(), options: c.options}
+}
@@ -0,0 +1,159 @@
+package grpcproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fango6/proxyproto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+// rpcPeer the peer and the PROXY header of an RPC.
+type rpcPeer struct {
+	*peer.Peer
+	Header *proxyproto.Header
+}
+
+// serve serve the health service on ln, and record the peer of the last RPC.
+func serve(t *testing.T, ln net.Listener, opts ...grpc.ServerOption) <-chan rpcPeer {
+	peers := make(chan rpcPeer, 1)
+	record := func(ctx context.Context, h *proxyproto.Header) (context.Context, error) {
+		p, _ := peer.FromContext(ctx)
+		select {
+		case peers <- rpcPeer{Peer: p, Header: h}:
+		default:
+		}
+		return ctx, nil
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(UnaryServerInterceptor(record)))
+	srv := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return peers
+}
+
+func newTestHeader(tlvs ...proxyproto.TLV) *proxyproto.Header {
+	return &proxyproto.Header{
+		Version: proxyproto.Version2,
+		Command: proxyproto.CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+		TLVs:    tlvs,
+	}
+}
+
+func check(t *testing.T, addr string, opts ...grpc.DialOption) error {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	cc, err := grpc.NewClient("passthrough:///"+addr, opts...)
+	require.NoError(t, err)
+	defer cc.Close()
+	_, err = healthpb.NewHealthClient(cc).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestNewCredentials(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	peers := serve(t, ln, grpc.Creds(NewCredentials(nil)))
+
+	require.NoError(t, check(t, ln.Addr().String(), WithDialHeader(newTestHeader())))
+	p := <-peers
+	require.Equal(t, "192.0.2.60:56324", p.Addr.String())
+	_, wrapped := p.AuthInfo.(AuthInfo)
+	require.False(t, wrapped)
+	require.Equal(t, "insecure", p.AuthInfo.AuthType())
+	require.Equal(t, ln.Addr().String(), p.Header.DstAddr.String())
+
+	// the PROXY protocol is not used
+	require.NoError(t, check(t, ln.Addr().String()))
+	p = <-peers
+	require.NotEqual(t, "192.0.2.60:56324", p.Addr.String())
+	require.Nil(t, p.Header)
+}
+
+func TestNewCredentials_TLS(t *testing.T) {
+	cert, pool := newTestCertificate(t, "example.com")
+	creds := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	peers := serve(t, ln, grpc.Creds(NewCredentials(creds)))
+
+	clientCreds := credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: "example.com"})
+	require.NoError(t, check(t, ln.Addr().String(), grpc.WithTransportCredentials(clientCreds), WithDialHeader(newTestHeader())))
+	p := <-peers
+	require.Equal(t, "192.0.2.60:56324", p.Addr.String())
+	require.Equal(t, "192.0.2.60:56324", p.Header.SrcAddr.String())
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	require.True(t, ok)
+	require.True(t, info.State.HandshakeComplete)
+	require.Equal(t, credentials.PrivacyAndIntegrity, info.SecurityLevel)
+}
+
+func TestNewCredentials_Listener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	peers := serve(t, proxyproto.NewListener(ln), grpc.Creds(NewCredentials(nil)))
+
+	h := newTestHeader(proxyproto.NewTLV(proxyproto.PP2_TYPE_AUTHORITY, []byte("example.com")))
+	require.NoError(t, check(t, ln.Addr().String(), WithDialHeader(h)))
+	p := <-peers
+	require.Equal(t, "192.0.2.60:56324", p.Addr.String())
+	tlv, ok := p.Header.TLVs.Find(proxyproto.PP2_TYPE_AUTHORITY)
+	require.True(t, ok)
+	require.Equal(t, "example.com", string(tlv.Value))
+}
+
+func TestAuthInfo_GetCommonAuthInfo(t *testing.T) {
+	info := AuthInfo{AuthInfo: credentials.TLSInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+	}}
+	require.Equal(t, credentials.PrivacyAndIntegrity, info.GetCommonAuthInfo().SecurityLevel)
+	require.NoError(t, credentials.CheckSecurityLevel(info, credentials.PrivacyAndIntegrity))
+
+	_, ok := info.Unwrap().(credentials.TLSInfo)
+	require.True(t, ok)
+
+	info = AuthInfo{AuthInfo: unknownAuthInfo{}}
+	require.Equal(t, credentials.InvalidSecurityLevel, info.GetCommonAuthInfo().SecurityLevel)
+}
+
+func newTestCertificate(t testing.TB, cn string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+type unknownAuthInfo struct{}
+
+func (unknownAuthInfo) AuthType() string { return "unknown" }
@@ -0,0 +1,18 @@
+package grpcproxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/fango6/proxyproto"
+	"google.golang.org/grpc"
+)
+
+// WithDialHeader dial connections sending the PROXY header first, the destination address
+// of header is the dialed address if nil. opts are applied to proxyproto.ClientConn.
+func WithDialHeader(h *proxyproto.Header, opts ...proxyproto.ClientOption) grpc.DialOption {
+	d := &proxyproto.Dialer{Options: opts}
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.DialContext(proxyproto.ContextWithHeader(ctx, h), "tcp", addr)
+	})
+}
@@ -0,0 +1,87 @@
+package grpcproxy
+
+import (
+	"context"
+
+	"github.com/fango6/proxyproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// HeaderFunc inspect the PROXY header of the RPC, such as adding fields of logging to the context,
+// or authorizing by the source address and TLVs. the header is nil if the PROXY protocol is not used.
+// the RPC fails with the error returned, it is better to be an error of the status package.
+type HeaderFunc func(ctx context.Context, h *proxyproto.Header) (context.Context, error)
+
+type headerKey struct{}
+
+// HeaderFromContext get the PROXY header of the RPC, the server must use NewCredentials.
+func HeaderFromContext(ctx context.Context) (*proxyproto.Header, bool) {
+	if h, ok := ctx.Value(headerKey{}).(*proxyproto.Header); ok {
+		return h, h != nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	if !ok || info.Header == nil {
+		return nil, false
+	}
+	return info.Header, true
+}
+
+// unwrapPeer put the PROXY header in the context, and replace AuthInfo of peer.Peer
+// by the AuthInfo of the wrapped credentials.
+func unwrapPeer(ctx context.Context) (context.Context, *proxyproto.Header) {
+	h, _ := HeaderFromContext(ctx)
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, h
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	if !ok {
+		return ctx, h
+	}
+	unwrapped := *p
+	unwrapped.AuthInfo = info.Unwrap()
+	ctx = peer.NewContext(ctx, &unwrapped)
+	return context.WithValue(ctx, headerKey{}, h), h
+}
+
+// UnaryServerInterceptor call fn with the PROXY header before the handler,
+// AuthInfo of peer.Peer is the one of the wrapped credentials since then.
+func UnaryServerInterceptor(fn HeaderFunc) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, h := unwrapPeer(ctx)
+		ctx, err := fn(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor call fn with the PROXY header before the handler,
+// the context returned by fn is the context of stream, AuthInfo of peer.Peer is the one of
+// the wrapped credentials since then.
+func StreamServerInterceptor(fn HeaderFunc) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, h := unwrapPeer(ss.Context())
+		ctx, err := fn(ctx, h)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream the stream with the context replaced.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
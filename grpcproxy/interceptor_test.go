@@ -0,0 +1,115 @@
+package grpcproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/fango6/proxyproto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type vpceKey struct{}
+
+// authorize allow the VPC endpoint only, and carry it by the context like fields of logging.
+func authorize(ctx context.Context, h *proxyproto.Header) (context.Context, error) {
+	if h.VpceID() != "vpce-allowed" {
+		return nil, status.Error(codes.PermissionDenied, "unknown VPC endpoint")
+	}
+	if got, ok := HeaderFromContext(ctx); !ok || got != h {
+		return nil, status.Error(codes.Internal, "header is not in context")
+	}
+	return context.WithValue(ctx, vpceKey{}, h.VpceID()), nil
+}
+
+// watchServer check the context of stream.
+type watchServer struct {
+	*health.Server
+}
+
+func (s watchServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if stream.Context().Value(vpceKey{}) != "vpce-allowed" {
+		return status.Error(codes.Internal, "context is not replaced")
+	}
+	return s.Server.Watch(req, stream)
+}
+
+func TestServerInterceptors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer(
+		grpc.Creds(NewCredentials(nil)),
+		grpc.UnaryInterceptor(UnaryServerInterceptor(authorize)),
+		grpc.StreamInterceptor(StreamServerInterceptor(authorize)),
+	)
+	healthpb.RegisterHealthServer(srv, watchServer{health.NewServer()})
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	tests := []struct {
+		name string
+		h    *proxyproto.Header
+		want codes.Code
+	}{
+		{name: "allowed", h: newTestHeader(proxyproto.NewTLV(0xEA, []byte("\x01vpce-allowed"))), want: codes.OK},
+		{name: "denied", h: newTestHeader(proxyproto.NewTLV(0xEA, []byte("\x01vpce-denied"))), want: codes.PermissionDenied},
+		{name: "no-header", want: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+			if tt.h != nil {
+				opts = append(opts, WithDialHeader(tt.h))
+			}
+			cc, err := grpc.NewClient("passthrough:///"+ln.Addr().String(), opts...)
+			require.NoError(t, err)
+			defer cc.Close()
+			client := healthpb.NewHealthClient(cc)
+
+			_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+			require.Equal(t, tt.want, status.Code(err))
+
+			stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			require.Equal(t, tt.want, status.Code(err))
+		})
+	}
+}
+
+func TestHeaderFromContext(t *testing.T) {
+	_, ok := HeaderFromContext(context.Background())
+	require.False(t, ok)
+
+	h := newTestHeader()
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: AuthInfo{AuthInfo: credentials.TLSInfo{}, Header: h}})
+	got, ok := HeaderFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, h, got)
+
+	// the peer is unwrapped, and the header is kept in the context
+	ctx, got = unwrapPeer(ctx)
+	require.Equal(t, h, got)
+	p, _ := peer.FromContext(ctx)
+	_, ok = p.AuthInfo.(credentials.TLSInfo)
+	require.True(t, ok)
+	got, ok = HeaderFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, h, got)
+
+	// unwrapped again by chained interceptors
+	ctx, got = unwrapPeer(ctx)
+	require.Equal(t, h, got)
+
+	ctx, _ = unwrapPeer(peer.NewContext(context.Background(), &peer.Peer{AuthInfo: AuthInfo{AuthInfo: credentials.TLSInfo{}}}))
+	_, ok = HeaderFromContext(ctx)
+	require.False(t, ok)
+}
@@ -3,9 +3,11 @@ package proxyproto
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"go.uber.org/zap"
@@ -29,6 +31,9 @@ type Header struct {
 
 	Raw  []byte // raw proxy protocol header
 	TLVs TLVs   // all of TLV groups
+
+	ChecksumPresent  bool // true if CRC-32c checksum (PP2_TYPE_CRC32C) is present, pp2 only
+	ChecksumVerified bool // true if CRC-32c checksum is present and verified
 }
 
 const (
@@ -58,7 +63,44 @@ var (
 	ErrNoProxyProtocol = errors.New("proxy protocol prefix not present")
 )
 
+// ReadHeader read and parse PROXY header with the lenient profile.
 func ReadHeader(reader *bufio.Reader) (*Header, error) {
+	return ReadHeaderWithProfile(reader, ProfileLenient)
+}
+
+// ReadHeaderContext read and parse PROXY header from conn through reader with the profile,
+// like ReadHeaderWithProfile, but the read is interrupted once ctx is done. the read deadline of conn
+// is set to the deadline of ctx, or to the past once ctx is done, and cleared before returning.
+func ReadHeaderContext(ctx context.Context, conn net.Conn, reader *bufio.Reader, profile ParseProfile) (*Header, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return ReadHeaderWithProfile(reader, profile)
+	}
+
+	d, _ := ctx.Deadline()
+	if err := conn.SetReadDeadline(d); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	stop := afterFunc(ctx, func() { conn.SetReadDeadline(aLongTimeAgo) })
+	defer stop()
+
+	header, err := ReadHeaderWithProfile(reader, profile)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		} else if !d.IsZero() && !time.Now().Before(d) {
+			// the read deadline may fire a little earlier than the context
+			return nil, context.DeadlineExceeded
+		}
+	}
+	return header, err
+}
+
+// ReadHeaderWithProfile read and parse PROXY header with the given profile.
+func ReadHeaderWithProfile(reader *bufio.Reader, profile ParseProfile) (*Header, error) {
 	prefix, err := reader.Peek(len(v1Prefix))
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -68,7 +110,7 @@ func ReadHeader(reader *bufio.Reader) (*Header, error) {
 	}
 
 	if bytes.Equal(prefix, v1Prefix) {
-		return readAndParseV1(reader)
+		return readAndParseV1(reader, profile)
 	} else if !bytes.HasPrefix(v2Signature, prefix) {
 		return nil, ErrNoProxyProtocol
 	}
@@ -82,24 +124,52 @@ func ReadHeader(reader *bufio.Reader) (*Header, error) {
 	}
 
 	if bytes.Equal(prefix, v2Signature) {
-		return readAndParseV2(reader)
+		return readAndParseV2(reader, profile)
 	}
 	return nil, ErrNoProxyProtocol
 }
 
-// Format format header to bytes.
-func (h *Header) Format() ([]byte, error) {
-	return formatHeader(h, false)
+// Format format header to bytes, options are applied to pp2 only.
+func (h *Header) Format(opts ...FormatOption) ([]byte, error) {
+	return formatHeader(h, false, opts...)
 }
 
 // FormatWithChecksum formater header to bytes, and append checksum with CRC-32c.
-func (h *Header) FormatWithChecksum() ([]byte, error) {
-	return formatHeader(h, true)
+func (h *Header) FormatWithChecksum(opts ...FormatOption) ([]byte, error) {
+	return formatHeader(h, true, opts...)
+}
+
+// AppendFormat append the formatted header to dst, and return the extended buffer.
+// unlike Format, the header is not modified, and nothing is allocated if dst is large enough.
+func (h *Header) AppendFormat(dst []byte, opts ...FormatOption) ([]byte, error) {
+	return appendHeader(dst, h, false, opts...)
 }
 
-// WriteTo implements io.WriteTo
-func (h *Header) WriteTo(w io.Writer) (int, error) {
-	return w.Write(h.Raw)
+// AppendFormatWithChecksum the same as AppendFormat, and append checksum with CRC-32c.
+func (h *Header) AppendFormatWithChecksum(dst []byte, opts ...FormatOption) ([]byte, error) {
+	return appendHeader(dst, h, true, opts...)
+}
+
+// WriteTo implements io.WriterTo, the header is formatted on demand if Raw is nil.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	return WriteHeader(w, h)
+}
+
+// VpceID find VPC endpoint ID in TLVs, such as the one of AWS PrivateLink.
+// an unregistered PP2Type will be choosen, and the first byte discarded.
+func (h *Header) VpceID() string {
+	if h == nil {
+		return ""
+	}
+	for _, tlv := range h.TLVs {
+		if !tlv.IsRegistered() {
+			if len(tlv.Value) == 0 {
+				return ""
+			}
+			return string(tlv.Value[1:])
+		}
+	}
+	return ""
 }
 
 func (h *Header) ZapFields() []zap.Field {
@@ -120,7 +190,7 @@ func (h *Header) ZapFields() []zap.Field {
 		zap.String("source_address", srcAddr),
 		zap.String("destination_address", dstAddr),
 	)
-	if h.Version == Version2 && h.Command == CMD_PROXY && len(h.TLVs) > 0 {
+	if h.Version == Version2 && len(h.TLVs) > 0 {
 		fields = append(fields, zap.String("tlv_groups", h.TLVs.String()))
 	}
 	return fields
@@ -142,7 +212,7 @@ func (h *Header) LogrusFields() logrus.Fields {
 	fields["transport_protocol"] = h.TransportProtocol.String()
 	fields["source_address"] = srcAddr
 	fields["destination_address"] = dstAddr
-	if h.Version == Version2 && h.Command == CMD_PROXY && len(h.TLVs) > 0 {
+	if h.Version == Version2 && len(h.TLVs) > 0 {
 		fields["tlv_groups"] = h.TLVs.String()
 	}
 	return fields
@@ -161,19 +231,21 @@ func (v Version) String() string {
 func (c Command) String() string {
 	switch c {
 	case CMD_LOCAL:
-		return "V1"
+		return "LOCAL"
 	case CMD_PROXY:
-		return "V2"
+		return "PROXY"
 	}
 	return Unknown
 }
 
 func (af AddressFamily) String() string {
 	switch af {
+	case AF_UNSPEC:
+		return "Unspec"
 	case AF_INET:
 		return "IPv4"
 	case AF_INET6:
-		return "IPv4"
+		return "IPv6"
 	case AF_UNIX:
 		return "Unix"
 	}
@@ -182,6 +254,8 @@ func (af AddressFamily) String() string {
 
 func (tp TransportProtocol) String() string {
 	switch tp {
+	case SOCK_UNSPEC:
+		return "Unspec"
 	case SOCK_STREAM:
 		return "TCP"
 	case SOCK_DGRAM:
@@ -2,8 +2,10 @@ package proxyproto
 
 import (
 	"bufio"
+	"context"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -30,3 +32,85 @@ func TestReadHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestReadHeaderContext(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		client, server := newTCPPair(t)
+		client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		got, err := ReadHeaderContext(ctx, server, bufio.NewReader(server), ProfileLenient)
+		require.NoError(t, err)
+		require.Equal(t, "192.168.0.1:56324", got.SrcAddr.String())
+	})
+
+	t.Run("profile", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		// leading zeros are accepted by the lenient profile only
+		for profile, wantErr := range map[ParseProfile]string{ProfileLenient: "", ProfileStrict: "source port: leading zeros in port"} {
+			client, server := newTCPPair(t)
+			client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 00080 443\r\n"))
+			_, err := ReadHeaderContext(ctx, server, bufio.NewReader(server), profile)
+			if wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, wantErr)
+			}
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		_, server := newTCPPair(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		reader := bufio.NewReader(server)
+		_, err := ReadHeaderContext(ctx, server, reader, ProfileLenient)
+		require.ErrorIs(t, err, context.Canceled)
+
+		// the read is interrupted rather than left behind, the connection is usable again
+		client, server := newTCPPair(t)
+		reader = bufio.NewReader(server)
+		ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = ReadHeaderContext(ctx, server, reader, ProfileLenient)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+		got, err := ReadHeaderContext(context.Background(), server, reader, ProfileLenient)
+		require.NoError(t, err)
+		require.Equal(t, "192.168.0.1:56324", got.SrcAddr.String())
+	})
+}
+
+func TestHeader_VpceID(t *testing.T) {
+	tests := []struct {
+		name string
+		h    *Header
+		want string
+	}{
+		{name: "nil"},
+		{name: "no-tlvs", h: &Header{}},
+		{
+			name: "registered-only",
+			h:    &Header{TLVs: TLVs{NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com"))}},
+		}, {
+			name: "empty-value",
+			h:    &Header{TLVs: TLVs{{Type: 0xEA}}},
+		}, {
+			name: "vpce",
+			h: &Header{TLVs: TLVs{
+				NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com")),
+				NewTLV(0xEA, []byte("\x01vpce-0123456789abcdef0")),
+			}},
+			want: "vpce-0123456789abcdef0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.h.VpceID())
+		})
+	}
+}
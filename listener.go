@@ -1,41 +1,123 @@
 package proxyproto
 
 import (
+	"context"
+	"errors"
 	"net"
 	"time"
 )
 
-const (
-	defaultReadHeaderTimeout = time.Second * 5
-)
+// DefaultReadHeaderTimeout the timeout of reading header of connections accepted by Listener,
+// unless WithReadHeaderTimeout is set.
+const DefaultReadHeaderTimeout = time.Second * 5
 
 type Listener struct {
 	net.Listener
 
 	options []Option
+
+	// ctx is canceled once the listener is closed, it aborts reading headers before Accept returns,
+	// connections already accepted are not affected.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// handshakeFirst headers are read concurrently before Accept returns, if policies are enforced.
+	handshakeFirst bool
+	accepted       chan net.Conn
+	acceptErrs     chan error
+	acceptDone     chan struct{} // closed once the underlying listener is closed
+	acceptErr      error
 }
 
 func NewListener(listener net.Listener, opts ...Option) *Listener {
-	return &Listener{
-		Listener: listener,
-		options:  opts,
+	ctx, cancel := context.WithCancel(context.Background())
+	var probe Conn
+	for _, o := range opts {
+		o(&probe)
+	}
+	ln := &Listener{
+		Listener:       listener,
+		options:        opts,
+		ctx:            ctx,
+		cancel:         cancel,
+		handshakeFirst: probe.handshakeBeforeAccept(),
 	}
+	if ln.handshakeFirst {
+		ln.accepted = make(chan net.Conn)
+		ln.acceptErrs = make(chan error)
+		ln.acceptDone = make(chan struct{})
+		go ln.acceptLoop()
+	}
+	return ln
 }
 
 func (ln *Listener) Accept() (net.Conn, error) {
-	rawConn, err := ln.Listener.Accept()
-	if err != nil {
+	if !ln.handshakeFirst {
+		rawConn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return ln.newConn(rawConn), nil
+	}
+
+	select {
+	case conn := <-ln.accepted:
+		return conn, nil
+	case err := <-ln.acceptErrs:
 		return nil, err
+	case <-ln.acceptDone:
+		return nil, ln.acceptErr
+	case <-ln.ctx.Done():
+		return nil, net.ErrClosed
 	}
+}
+
+// acceptLoop accept connections, and hand them over to Accept once their headers are read.
+// connections violating policies are closed by the handshake, and dropped here.
+func (ln *Listener) acceptLoop() {
+	for {
+		rawConn, err := ln.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				ln.acceptErr = err
+				close(ln.acceptDone)
+				return
+			}
+			select {
+			case ln.acceptErrs <- err:
+				continue
+			case <-ln.ctx.Done():
+				return
+			}
+		}
+
+		conn := ln.newConn(rawConn)
+		go func() {
+			if err := conn.Handshake(ln.ctx); isPolicyViolation(err) {
+				return
+			}
+			select {
+			case ln.accepted <- conn:
+			case <-ln.ctx.Done():
+				conn.Close()
+			}
+		}()
+	}
+}
 
+func (ln *Listener) newConn(rawConn net.Conn) *Conn {
 	conn := NewConn(rawConn, ln.options...)
 	if conn.readHeaderTimeout <= 0 {
-		conn.readHeaderTimeout = defaultReadHeaderTimeout
+		conn.readHeaderTimeout = DefaultReadHeaderTimeout
 	}
-	return conn, nil
+	conn.listenAddr = ln.Listener.Addr()
+	return conn
 }
 
 func (ln *Listener) Close() error {
+	if ln.cancel != nil {
+		ln.cancel()
+	}
 	return ln.Listener.Close()
 }
 
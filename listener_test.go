@@ -0,0 +1,71 @@
+package proxyproto
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListener_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	_, ok := ln.(*net.UnixListener)
+	require.True(t, ok)
+
+	proxyListener := NewListener(ln)
+	t.Cleanup(func() { proxyListener.Close() })
+
+	h := &Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.UnixAddr{Net: "unix", Name: "@sidecar-client"},
+		DstAddr: &net.UnixAddr{Net: "unix", Name: "/var/run/app.sock"},
+	}
+	raw, err := h.Format()
+	require.NoError(t, err)
+
+	go func() {
+		client, err := net.Dial("unix", path)
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		client.Write(append(raw, "hello"...))
+	}()
+
+	conn, err := proxyListener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.Equal(t, h.SrcAddr, conn.RemoteAddr())
+	require.Equal(t, h.DstAddr, conn.LocalAddr())
+}
+
+func TestListener_CloseKeepsAccepted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxyListener := NewListener(ln, WithReadHeaderTimeout(time.Minute))
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := proxyListener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// graceful shutdown closes the listener, accepted connections go on reading header
+	require.NoError(t, proxyListener.Close())
+	client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+	require.NoError(t, conn.(*Conn).Handshake(context.Background()))
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+}
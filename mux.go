@@ -0,0 +1,264 @@
+package proxyproto
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// Matcher report whether the connection is routed by its header,
+// the header is nil if the PROXY protocol is not used by the connection.
+type Matcher func(h *Header) bool
+
+// MatchAny match any connection.
+func MatchAny() Matcher {
+	return func(h *Header) bool { return true }
+}
+
+// MatchVersion match headers of the version.
+func MatchVersion(v Version) Matcher {
+	return func(h *Header) bool {
+		return h != nil && h.Version == v
+	}
+}
+
+// MatchVpceID match headers carrying any of the VPC endpoint IDs.
+func MatchVpceID(ids ...string) Matcher {
+	return func(h *Header) bool {
+		id := h.VpceID()
+		for _, want := range ids {
+			if id != "" && id == want {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchAuthority match headers with PP2_TYPE_AUTHORITY of any of the hosts case-insensitively,
+// the port of authority is ignored if the host has none, "*.example.com" matches the subdomains.
+func MatchAuthority(hosts ...string) Matcher {
+	return func(h *Header) bool {
+		authority := h.authority()
+		if authority == "" {
+			return false
+		}
+		name := authority
+		if host, _, err := net.SplitHostPort(authority); err == nil {
+			name = host
+		}
+		for _, want := range hosts {
+			if strings.EqualFold(authority, want) || strings.EqualFold(name, want) {
+				return true
+			}
+			if strings.HasPrefix(want, "*.") && len(name) > len(want)-1 &&
+				strings.EqualFold(name[len(name)-len(want)+1:], want[1:]) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchALPN match headers with PP2_TYPE_ALPN of any of the protocols, such as "h2".
+func MatchALPN(protos ...string) Matcher {
+	return func(h *Header) bool {
+		if h == nil {
+			return false
+		}
+		tlv, ok := h.TLVs.Find(PP2_TYPE_ALPN)
+		if !ok {
+			return false
+		}
+		for _, want := range protos {
+			if string(tlv.Value) == want {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchDstPort match headers whose destination is any of the ports.
+func MatchDstPort(ports ...int) Matcher {
+	return func(h *Header) bool {
+		if h == nil || h.Command == CMD_LOCAL {
+			return false
+		}
+		ap, ok := addrPort(h.DstAddr)
+		if !ok {
+			return false
+		}
+		for _, want := range ports {
+			if int(ap.Port()) == want {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Mux route connections accepted by Listener to child listeners by their headers.
+// routes are matched in the order they are added, the first matched wins.
+// unmatched connections go to the default route, or the fallback if there is none.
+type Mux struct {
+	ln *Listener
+
+	mu       sync.Mutex
+	routes   []muxRoute
+	def      *muxListener
+	fallback func(conn *Conn)
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // returned by Accept of routes once done is closed
+}
+
+type muxRoute struct {
+	matchers []Matcher
+	ln       *muxListener
+}
+
+// NewMux create Mux over the listener, call Serve to start routing.
+func NewMux(ln *Listener) *Mux {
+	return &Mux{
+		ln:   ln,
+		done: make(chan struct{}),
+	}
+}
+
+// Match add a route of connections which match any of the matchers.
+func (m *Mux) Match(matchers ...Matcher) net.Listener {
+	l := m.newListener()
+	m.mu.Lock()
+	m.routes = append(m.routes, muxRoute{matchers: matchers, ln: l})
+	m.mu.Unlock()
+	return l
+}
+
+// Default the route of unmatched connections.
+func (m *Mux) Default() net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.def == nil {
+		m.def = m.newListener()
+	}
+	return m.def
+}
+
+// Fallback handle the connections which are not routed, because they are unmatched without
+// the default route, the route is closed, or the header is failed to read.
+// the connections are closed by default.
+func (m *Mux) Fallback(fn func(conn *Conn)) {
+	m.mu.Lock()
+	m.fallback = fn
+	m.mu.Unlock()
+}
+
+// Serve accept connections and route them until the listener is closed or fails,
+// the routes are closed then, and their Accept return the error.
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			m.shutdown(err)
+			return err
+		}
+		go m.route(conn.(*Conn))
+	}
+}
+
+// Close close the listener and all routes.
+func (m *Mux) Close() error {
+	m.shutdown(net.ErrClosed)
+	return m.ln.Close()
+}
+
+// shutdown close all routes with the error, only the first call takes effect.
+func (m *Mux) shutdown(err error) {
+	m.closeOnce.Do(func() {
+		m.err = err
+		close(m.done)
+	})
+}
+
+func (m *Mux) route(conn *Conn) {
+	err := conn.Err()
+	if isPolicyViolation(err) {
+		return
+	}
+
+	m.mu.Lock()
+	l, fallback := m.def, m.fallback
+	if err != nil {
+		l = nil
+	} else {
+		l = m.match(conn.Header(), l)
+	}
+	m.mu.Unlock()
+
+	if l != nil {
+		select {
+		case l.conns <- conn:
+			return
+		case <-l.done:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+	if fallback != nil {
+		fallback(conn)
+		return
+	}
+	conn.Close()
+}
+
+// match the first matched route, def if unmatched.
+func (m *Mux) match(h *Header, def *muxListener) *muxListener {
+	for _, route := range m.routes {
+		for _, match := range route.matchers {
+			if match(h) {
+				return route.ln
+			}
+		}
+	}
+	return def
+}
+
+func (m *Mux) newListener() *muxListener {
+	return &muxListener{
+		mux:   m,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// muxListener a child listener of Mux.
+type muxListener struct {
+	mux       *Mux
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.mux.done:
+		return nil, l.mux.err
+	}
+}
+
+// Close stop routing to the listener, the connections matched later go to the fallback.
+func (l *muxListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.mux.ln.Addr()
+}
@@ -0,0 +1,222 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchers(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8443}
+	h := &Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: src,
+		DstAddr: dst,
+		TLVs: TLVs{
+			NewTLV(PP2_TYPE_ALPN, []byte("h2")),
+			NewTLV(PP2_TYPE_AUTHORITY, []byte("Tenant.example.com:8443")),
+			NewTLV(0xEA, append([]byte{0x01}, "vpce-0123456789abcdef0"...)),
+		},
+	}
+	local := &Header{Version: Version2, Command: CMD_LOCAL, SrcAddr: src, DstAddr: dst}
+
+	tests := []struct {
+		name    string
+		matcher Matcher
+		want    bool
+	}{
+		{name: "any", matcher: MatchAny(), want: true},
+		{name: "version", matcher: MatchVersion(Version2), want: true},
+		{name: "other-version", matcher: MatchVersion(Version1)},
+		{name: "vpce", matcher: MatchVpceID("vpce-1", "vpce-0123456789abcdef0"), want: true},
+		{name: "other-vpce", matcher: MatchVpceID("vpce-1")},
+		{name: "authority", matcher: MatchAuthority("tenant.example.com:8443"), want: true},
+		{name: "authority-host", matcher: MatchAuthority("tenant.example.com"), want: true},
+		{name: "authority-wildcard", matcher: MatchAuthority("*.EXAMPLE.com"), want: true},
+		{name: "authority-wildcard-apex", matcher: MatchAuthority("*.tenant.example.com")},
+		{name: "other-authority", matcher: MatchAuthority("example.com")},
+		{name: "alpn", matcher: MatchALPN("http/1.1", "h2"), want: true},
+		{name: "other-alpn", matcher: MatchALPN("http/1.1")},
+		{name: "dst-port", matcher: MatchDstPort(443, 8443), want: true},
+		{name: "other-dst-port", matcher: MatchDstPort(443)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.matcher(h))
+			if tt.name != "any" {
+				require.False(t, tt.matcher(nil))
+			}
+		})
+	}
+	require.False(t, MatchDstPort(8443)(local))
+}
+
+func TestMux(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mux := NewMux(NewListener(ln))
+	defer mux.Close()
+
+	tenant := mux.Match(MatchAuthority("tenant.example.com"), MatchVpceID("vpce-tenant"))
+	grpc := mux.Match(MatchALPN("h2"))
+	v1 := mux.Match(MatchVersion(Version1))
+	def := mux.Default()
+	require.Equal(t, ln.Addr(), tenant.Addr())
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- mux.Serve() }()
+
+	dial := func(header string) net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		_, err = client.Write([]byte(header))
+		require.NoError(t, err)
+		return client
+	}
+	v2 := func(tlvs ...TLV) string {
+		raw, err := (&Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+			TLVs:    tlvs,
+		}).Format()
+		require.NoError(t, err)
+		return string(raw)
+	}
+	accept := func(l net.Listener) *Conn {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn.(*Conn)
+	}
+
+	dial(v2(NewTLV(PP2_TYPE_AUTHORITY, []byte("tenant.example.com"))))
+	require.Equal(t, "tenant.example.com", accept(tenant).Header().authority())
+
+	dial(v2(NewTLV(0xEA, append([]byte{0x01}, "vpce-tenant"...))))
+	require.Equal(t, "vpce-tenant", accept(tenant).GetVpceID())
+
+	// the first matched route wins
+	dial(v2(NewTLV(PP2_TYPE_ALPN, []byte("h2")), NewTLV(PP2_TYPE_AUTHORITY, []byte("tenant.example.com"))))
+	require.Equal(t, "h2", string(accept(tenant).TLVs()[0].Value))
+	dial(v2(NewTLV(PP2_TYPE_ALPN, []byte("h2"))))
+	require.Equal(t, "h2", string(accept(grpc).TLVs()[0].Value))
+
+	dial("PROXY TCP4 192.0.2.60 192.0.2.1 56324 443\r\n")
+	require.Equal(t, Version1, accept(v1).Header().Version)
+
+	dial(v2())
+	require.NotNil(t, accept(def).Header())
+	dial("GET / HTTP/1.1\r\n\r\n")
+	require.Nil(t, accept(def).Header())
+
+	// closed routes go to the fallback
+	fallback := make(chan *Conn, 1)
+	mux.Fallback(func(conn *Conn) { fallback <- conn })
+	require.NoError(t, def.Close())
+	_, err = def.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	dial(v2())
+	select {
+	case conn := <-fallback:
+		conn.Close()
+	case <-time.After(DefaultReadHeaderTimeout):
+		t.Fatal("not routed to the fallback")
+	}
+
+	require.NoError(t, mux.Close())
+	require.ErrorIs(t, <-serveErr, net.ErrClosed)
+	_, err = tenant.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestMux_Unmatched(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mux := NewMux(NewListener(ln))
+	defer mux.Close()
+	mux.Match(MatchVersion(Version1))
+	go mux.Serve()
+
+	// without the default route and fallback, unmatched and invalid are closed
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4\r\n"))
+	require.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// failingListener fail to accept with err.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestMux_ListenerClosed(t *testing.T) {
+	errEMFILE := errors.New("too many open files")
+	tests := []struct {
+		name    string
+		ln      func(ln net.Listener) net.Listener
+		wantErr error
+	}{
+		{name: "closed", ln: func(ln net.Listener) net.Listener { return ln }, wantErr: net.ErrClosed},
+		{name: "accept-error", ln: func(ln net.Listener) net.Listener { return failingListener{Listener: ln, err: errEMFILE} }, wantErr: errEMFILE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			ln := NewListener(tt.ln(raw))
+			mux := NewMux(ln)
+			route, def := mux.Match(MatchAny()), mux.Default()
+
+			accepted := make(chan error, 2)
+			for _, l := range []net.Listener{route, def} {
+				go func(l net.Listener) {
+					_, err := l.Accept()
+					accepted <- err
+				}(l)
+			}
+			serveErr := make(chan error, 1)
+			go func() { serveErr <- mux.Serve() }()
+
+			// the parent listener is closed directly, not by Mux.Close
+			require.NoError(t, ln.Close())
+			require.ErrorIs(t, <-serveErr, tt.wantErr)
+			for i := 0; i < 2; i++ {
+				select {
+				case err := <-accepted:
+					require.ErrorIs(t, err, tt.wantErr)
+				case <-time.After(time.Second):
+					t.Fatal("Accept of route is blocked")
+				}
+			}
+			_, err = route.Accept()
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
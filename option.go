@@ -4,7 +4,8 @@ import "time"
 
 type Option func(*Conn)
 
-// WithReadHeaderTimeout read header with timeout
+// WithReadHeaderTimeout read header with timeout.
+// no timeout by default for NewConn, and 5 seconds for Listener.
 func WithReadHeaderTimeout(duration time.Duration) Option {
 	return func(c *Conn) {
 		c.readHeaderTimeout = duration
@@ -25,10 +26,170 @@ func WithPostReadHeader(fn PostReadHeader) Option {
 	}
 }
 
-// WithCRC32cChecksum validate CRC-32c checksum.
+// WithHealthCheck want to handle LOCAL connections of health checkers distinctly,
+// it will be called once the LOCAL header has been read.
+func WithHealthCheck(fn HealthCheck) Option {
+	return func(c *Conn) {
+		c.healthCheckFunc = fn
+	}
+}
+
+// WithCRC32cChecksum validate CRC-32c checksum if present.
 // pp2 (proxy protocol version 2) will validate it.
 func WithCRC32cChecksum(want bool) Option {
 	return func(c *Conn) {
-		c.checksum = want
+		c.checksumMode = ChecksumIgnore
+		if want {
+			c.checksumMode = ChecksumVerifyIfPresent
+		}
+	}
+}
+
+// WithChecksumMode validate CRC-32c checksum with the mode, default is ChecksumIgnore.
+func WithChecksumMode(mode ChecksumMode) Option {
+	return func(c *Conn) {
+		c.checksumMode = mode
+	}
+}
+
+// WithParseProfile parse header with the profile, default is lenient.
+func WithParseProfile(profile ParseProfile) Option {
+	return func(c *Conn) {
+		c.profile = profile
+	}
+}
+
+// FormatOption configure how the header is formatted by Header.Format.
+// it is a value rather than a function, so that formatting with options does not allocate.
+type FormatOption struct {
+	padding     paddingMode
+	paddingSize uint16
+}
+
+// paddingMode how the pp2 header is padded with a PP2_TYPE_NOOP TLV.
+type paddingMode byte
+
+const (
+	// paddingDefault append an 8-byte NOOP if TLVs or checksum are present.
+	paddingDefault paddingMode = iota
+	paddingNone
+	paddingFixed
+	paddingAlign
+)
+
+// mergeFormatOptions the later option wins.
+func mergeFormatOptions(opts ...FormatOption) FormatOption {
+	var o FormatOption
+	for _, opt := range opts {
+		o = opt
+	}
+	return o
+}
+
+// WithPaddingNone pp2 header is not padded.
+func WithPaddingNone() FormatOption {
+	return FormatOption{padding: paddingNone}
+}
+
+// WithPaddingFixed pp2 header is padded with a NOOP TLV whose value is size bytes,
+// such as to reserve space for rewriting TLVs in place.
+func WithPaddingFixed(size uint16) FormatOption {
+	return FormatOption{padding: paddingFixed, paddingSize: size}
+}
+
+// WithPaddingAlign pp2 header is padded with a NOOP TLV, so that the whole length is a multiple of n.
+// the NOOP takes at least 3 bytes, so n more bytes are padded if the gap is too small.
+func WithPaddingAlign(n uint16) FormatOption {
+	return FormatOption{padding: paddingAlign, paddingSize: n}
+}
+
+// WriteOption configure how the header is written by WriteHeader.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	wantChecksum bool
+	format       []FormatOption
+	payload      []byte
+}
+
+// WithWriteChecksum header is formatted with CRC-32c checksum, pp2 only.
+func WithWriteChecksum() WriteOption {
+	return func(o *writeOptions) {
+		o.wantChecksum = true
+	}
+}
+
+// WithWriteFormat header is formatted with the options, such as padding.
+func WithWriteFormat(opts ...FormatOption) WriteOption {
+	return func(o *writeOptions) {
+		o.format = append(o.format, opts...)
+	}
+}
+
+// WithInitialPayload the payload is written following the header,
+// they are coalesced into a single writev if supported, such as *net.TCPConn.
+func WithInitialPayload(payload []byte) WriteOption {
+	return func(o *writeOptions) {
+		o.payload = payload
+	}
+}
+
+// ClientOption configure ClientConn.
+type ClientOption func(*ClientConn)
+
+// WithFlushDelay send the header alone if nothing is written in the delay,
+// 100ms by default, zero or negative disables it, the header is still sent before reading.
+func WithFlushDelay(delay time.Duration) ClientOption {
+	return func(c *ClientConn) {
+		c.flushDelay = delay
+	}
+}
+
+// WithClientChecksum the header is formatted with CRC-32c checksum, pp2 only.
+func WithClientChecksum(want bool) ClientOption {
+	return func(c *ClientConn) {
+		c.wantChecksum = want
+	}
+}
+
+// WithClientFormat the header is formatted with the options, such as padding.
+func WithClientFormat(opts ...FormatOption) ClientOption {
+	return func(c *ClientConn) {
+		c.format = append(c.format, opts...)
+	}
+}
+
+// WithACL allow or deny the connection by the source address of the real client,
+// denied connections are closed, Listener never returns them from Accept.
+func WithACL(acl *ACL) Option {
+	return func(c *Conn) {
+		c.acl = acl
+	}
+}
+
+// WithRateLimit limit the rate of connections per real client by the source address,
+// connections exceeding the rate are closed, Listener never returns them from Accept.
+func WithRateLimit(rl *RateLimiter) Option {
+	return func(c *Conn) {
+		c.rateLimiter = rl
+	}
+}
+
+// WithDestinations validate the destination address of header against the expected,
+// unexpected connections are closed, Listener never returns them from Accept.
+func WithDestinations(d Destinations) Option {
+	return func(c *Conn) {
+		c.destinations = &d
+	}
+}
+
+// WithAllowedProtocols allow the connection only if its detected protocol is any of protos,
+// such as PROXY headers only, or TLS as well while migrating to PROXY-fronted deployments.
+// rejected connections are closed, Listener never returns them from Accept.
+func WithAllowedProtocols(protos ...Protocol) Option {
+	return func(c *Conn) {
+		for _, p := range protos {
+			c.allowedProtocols |= 1 << p
+		}
 	}
 }
@@ -0,0 +1,79 @@
+package proxyproto
+
+import (
+	"bytes"
+	"strings"
+)
+
+// ParseProfile how strictly the PROXY header is parsed.
+type ParseProfile byte
+
+const (
+	// ProfileLenient tolerates deviations seen from real-world senders:
+	//   - pp1 fields separated by runs of spaces or tabs, and trailing fields after the ports
+	//   - pp1 ports with leading zeros, and IPv4-mapped addresses in TCP4 or dotted IPv4 in TCP6
+	//   - pp2 address family and transport protocol pairs outside the specification table
+	//   - pp2 PROXY command with an empty payload, which is treated as LOCAL
+	ProfileLenient ParseProfile = iota
+	// ProfileStrict follows the specification exactly:
+	//   - pp1 fields separated by a single space, nothing between the destination port and the CRLF
+	//   - pp1 ports without leading zeros, addresses written in the notation of their family
+	//   - pp2 address family and transport protocol must be one of the specified pairs
+	ProfileStrict
+)
+
+// v2FamilyAndProtocols the specified pairs of address family and transport protocol.
+var v2FamilyAndProtocols = map[byte]bool{
+	0x00: true, // UNSPEC
+	0x11: true, // TCP over IPv4
+	0x12: true, // UDP over IPv4
+	0x21: true, // TCP over IPv6
+	0x22: true, // UDP over IPv6
+	0x31: true, // UNIX stream
+	0x32: true, // UNIX datagram
+}
+
+func (p ParseProfile) String() string {
+	switch p {
+	case ProfileLenient:
+		return "Lenient"
+	case ProfileStrict:
+		return "Strict"
+	}
+	return Unknown
+}
+
+// splitV1Fields split pp1 header into fields according to the profile.
+func splitV1Fields(raw []byte, profile ParseProfile) ([]string, error) {
+	if profile != ProfileStrict {
+		return strings.Fields(string(bytes.TrimSpace(raw))), nil
+	}
+
+	line := bytes.TrimSuffix(raw, []byte("\r\n"))
+	fields := strings.Split(string(line), " ")
+	if len(fields) < 2 || fields[1] == "" {
+		return nil, ErrNotFoundAddressFamily
+	}
+	// anything after UNKNOWN must be ignored by receivers
+	if fields[1] == "UNKNOWN" {
+		return fields[:2], nil
+	}
+	for _, field := range fields {
+		if field == "" || strings.ContainsAny(field, "\t\r\n") {
+			return nil, ErrInvalidFieldSeparator
+		}
+	}
+	if len(fields) > 6 {
+		return nil, ErrUnexpectedField
+	}
+	return fields, nil
+}
+
+// validateV1IPNotation the address must be written in the notation of its family.
+func validateV1IPNotation(ip string, af AddressFamily) error {
+	isIPv6 := strings.Contains(ip, ":")
+	if (af == AF_INET && isIPv6) || (af == AF_INET6 && !isIPv6) {
+		return ErrInvalidAddressNotation
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceTests nil error means the header is accepted by the profile.
+var conformanceTests = []struct {
+	name       string
+	raw        string
+	lenientErr error
+	strictErr  error
+}{
+	// version 1
+	{
+		name: "v1-tcp4",
+		raw:  "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+	}, {
+		name: "v1-tcp6",
+		raw:  "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+	}, {
+		name: "v1-unknown",
+		raw:  "PROXY UNKNOWN\r\n",
+	}, {
+		name: "v1-unknown-with-addresses",
+		raw:  "PROXY UNKNOWN ffff:f::f ffff:f::f 65535 65535\r\n",
+	}, {
+		name: "v1-port-zero",
+		raw:  "PROXY TCP4 192.168.0.1 192.168.0.11 0 443\r\n",
+	}, {
+		name: "v1-port-max",
+		raw:  "PROXY TCP4 192.168.0.1 192.168.0.11 65535 443\r\n",
+	}, {
+		name:       "v1-port-overflow",
+		raw:        "PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n",
+		lenientErr: errors.New("source port: invalid port"),
+		strictErr:  errors.New("source port: invalid port"),
+	}, {
+		name:       "v1-port-signed",
+		raw:        "PROXY TCP4 192.168.0.1 192.168.0.11 +80 443\r\n",
+		lenientErr: errors.New("source port: invalid port"),
+		strictErr:  errors.New("source port: invalid port"),
+	}, {
+		name:      "v1-port-leading-zeros",
+		raw:       "PROXY TCP4 192.168.0.1 192.168.0.11 00080 443\r\n",
+		strictErr: errors.New("source port: leading zeros in port"),
+	}, {
+		name:       "v1-ipv4-leading-zeros",
+		raw:        "PROXY TCP4 192.168.000.1 192.168.0.11 56324 443\r\n",
+		lenientErr: errors.New("source IP: invalid or empty IP"),
+		strictErr:  errors.New("source IP: invalid or empty IP"),
+	}, {
+		name:      "v1-double-spaces",
+		raw:       "PROXY TCP4  192.168.0.1 192.168.0.11 56324 443\r\n",
+		strictErr: ErrInvalidFieldSeparator,
+	}, {
+		name:      "v1-tab-separator",
+		raw:       "PROXY TCP4 192.168.0.1\t192.168.0.11 56324 443\r\n",
+		strictErr: ErrInvalidFieldSeparator,
+	}, {
+		name:      "v1-trailing-space",
+		raw:       "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443 \r\n",
+		strictErr: ErrInvalidFieldSeparator,
+	}, {
+		name:      "v1-trailing-garbage",
+		raw:       "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443 garbage\r\n",
+		strictErr: ErrUnexpectedField,
+	}, {
+		name:      "v1-tcp4-mapped-address",
+		raw:       "PROXY TCP4 ::ffff:192.168.0.1 192.168.0.11 56324 443\r\n",
+		strictErr: errors.New("source IP: pp1 address notation does not match the address family"),
+	}, {
+		name:      "v1-tcp6-dotted-address",
+		raw:       "PROXY TCP6 192.168.0.1 2001:db8::2 56324 443\r\n",
+		strictErr: errors.New("source IP: pp1 address notation does not match the address family"),
+	}, {
+		name:       "v1-lowercase-protocol",
+		raw:        "PROXY tcp4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		lenientErr: ErrInvalidAddressFamily,
+		strictErr:  ErrInvalidAddressFamily,
+	},
+	// version 2
+	{
+		name: "v2-local-unspec",
+		raw:  "\r\n\r\n\x00\r\nQUIT\n" + "\x20\x00\x00\x00",
+	}, {
+		name: "v2-proxy-unspec",
+		raw:  "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x00\x00\x00",
+	}, {
+		name: "v2-proxy-port-zero",
+		raw: "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x11\x00\x0C" +
+			"\xC0\xA8\x00\x01\xC0\xA8\x00\x0B\x00\x00\x01\xBB",
+	}, {
+		name: "v2-proxy-port-max",
+		raw: "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x11\x00\x0C" +
+			"\xC0\xA8\x00\x01\xC0\xA8\x00\x0B\xFF\xFF\x01\xBB",
+	}, {
+		name: "v2-proxy-udp4",
+		raw: "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x12\x00\x0C" +
+			"\xC0\xA8\x00\x01\xC0\xA8\x00\x0B\xDC\x04\x01\xBB",
+	}, {
+		name: "v2-proxy-inet-unspec-transport",
+		raw: "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x10\x00\x0C" +
+			"\xC0\xA8\x00\x01\xC0\xA8\x00\x0B\xDC\x04\x01\xBB",
+		strictErr: ErrUnknownAddrFamilyAndTranProtocol,
+	}, {
+		name:      "v2-proxy-unspec-family-stream",
+		raw:       "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x01\x00\x00",
+		strictErr: ErrUnknownAddrFamilyAndTranProtocol,
+	}, {
+		name:      "v2-proxy-empty-payload",
+		raw:       "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x11\x00\x00",
+		strictErr: ErrPayloadLengthTooShort,
+	}, {
+		name:       "v2-unknown-family",
+		raw:        "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x41\x00\x00",
+		lenientErr: ErrUnknownAddrFamilyAndTranProtocol,
+		strictErr:  ErrUnknownAddrFamilyAndTranProtocol,
+	}, {
+		name:       "v2-unknown-command",
+		raw:        "\r\n\r\n\x00\r\nQUIT\n" + "\x22\x11\x00\x00",
+		lenientErr: ErrUnknownVersionAndCommand,
+		strictErr:  ErrUnknownVersionAndCommand,
+	},
+}
+
+func TestReadHeaderWithProfile(t *testing.T) {
+	for _, tt := range conformanceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			for profile, wantErr := range map[ParseProfile]error{
+				ProfileLenient: tt.lenientErr,
+				ProfileStrict:  tt.strictErr,
+			} {
+				reader := bufio.NewReader(strings.NewReader(tt.raw))
+				got, err := ReadHeaderWithProfile(reader, profile)
+				if wantErr != nil {
+					require.EqualError(t, err, wantErr.Error(), profile.String())
+					continue
+				}
+				require.NoError(t, err, profile.String())
+				require.NotNil(t, got, profile.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package proxyproto
+
+// raceEnabled the race detector instruments allocations, so allocation tests are skipped.
+const raceEnabled = true
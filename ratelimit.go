@@ -0,0 +1,159 @@
+package proxyproto
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitEntries = 65536
+)
+
+var ErrRateLimited = errors.New("proxyproto source address is rate limited")
+
+// RejectBehavior how to close the connection which exceeds the rate.
+type RejectBehavior int
+
+const (
+	// RejectClose close the connection gracefully.
+	RejectClose RejectBehavior = iota
+	// RejectReset reset the TCP connection, no TIME_WAIT is kept for it.
+	RejectReset
+)
+
+// RateLimitOption option of RateLimiter.
+type RateLimitOption func(*RateLimiter)
+
+// WithRateLimitPrefix share a bucket by the clients in the same prefix, such as /24 and /64.
+// the default is 32 and 128, a bucket per address.
+func WithRateLimitPrefix(v4Bits, v6Bits int) RateLimitOption {
+	return func(rl *RateLimiter) {
+		if v4Bits >= 0 && v4Bits <= 32 {
+			rl.v4Bits = v4Bits
+		}
+		if v6Bits >= 0 && v6Bits <= 128 {
+			rl.v6Bits = v6Bits
+		}
+	}
+}
+
+// WithRateLimitEntries the max number of buckets, the least recently used is evicted beyond it.
+func WithRateLimitEntries(n int) RateLimitOption {
+	return func(rl *RateLimiter) {
+		if n > 0 {
+			rl.maxEntries = n
+		}
+	}
+}
+
+// WithRateLimitReject how to close the connection which exceeds the rate.
+func WithRateLimitReject(behavior RejectBehavior) RateLimitOption {
+	return func(rl *RateLimiter) {
+		rl.reject = behavior
+	}
+}
+
+// RateLimiter token bucket of connections per real client, keyed by its source prefix.
+type RateLimiter struct {
+	rate       float64 // tokens per second
+	burst      float64
+	v4Bits     int
+	v6Bits     int
+	maxEntries int
+	reject     RejectBehavior
+
+	mu      sync.Mutex
+	buckets map[netip.Prefix]*list.Element
+	lru     *list.List // front is the most recently used
+	now     func() time.Time
+}
+
+type rateBucket struct {
+	key    netip.Prefix
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter create RateLimiter allowing rate connections per second,
+// with bursts of at most burst connections.
+func NewRateLimiter(rate float64, burst int, opts ...RateLimitOption) *RateLimiter {
+	rl := &RateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		v4Bits:     32,
+		v6Bits:     128,
+		maxEntries: defaultRateLimitEntries,
+		buckets:    make(map[netip.Prefix]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+	for _, o := range opts {
+		o(rl)
+	}
+	return rl
+}
+
+// Allow take a token from the bucket of the address, false if the bucket is empty.
+func (rl *RateLimiter) Allow(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	bits := rl.v6Bits
+	if addr.Is4() {
+		bits = rl.v4Bits
+	}
+	key, err := addr.Prefix(bits)
+	if err != nil {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	var b *rateBucket
+	if elem, ok := rl.buckets[key]; ok {
+		rl.lru.MoveToFront(elem)
+		b = elem.Value.(*rateBucket)
+		b.tokens += now.Sub(b.last).Seconds() * rl.rate
+		if b.tokens > rl.burst {
+			b.tokens = rl.burst
+		}
+		b.last = now
+	} else {
+		b = &rateBucket{key: key, tokens: rl.burst, last: now}
+		rl.buckets[key] = rl.lru.PushFront(b)
+		for rl.lru.Len() > rl.maxEntries {
+			oldest := rl.lru.Back()
+			rl.lru.Remove(oldest)
+			delete(rl.buckets, oldest.Value.(*rateBucket).key)
+		}
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowAddr take a token by the address, addresses other than IP are always allowed.
+func (rl *RateLimiter) allowAddr(addr net.Addr) bool {
+	ap, ok := netip.AddrFromSlice(addrIP(addr))
+	if !ok {
+		return true
+	}
+	return rl.Allow(ap)
+}
+
+// close the connection by the reject behavior.
+func (rl *RateLimiter) close(conn net.Conn) error {
+	if rl.reject == RejectReset {
+		if lc, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+			lc.SetLinger(0)
+		}
+	}
+	return conn.Close()
+}
@@ -0,0 +1,164 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	var now = time.Unix(1700000000, 0)
+	rl := NewRateLimiter(1, 2, WithRateLimitPrefix(24, 64))
+	rl.now = func() time.Time { return now }
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	require.True(t, rl.Allow(addr))
+	require.True(t, rl.Allow(addr))
+	require.False(t, rl.Allow(addr))
+
+	// the same /24 shares the bucket
+	require.False(t, rl.Allow(netip.MustParseAddr("192.0.2.200")))
+	require.False(t, rl.Allow(netip.MustParseAddr("::ffff:192.0.2.2")))
+	require.True(t, rl.Allow(netip.MustParseAddr("192.0.3.1")))
+
+	// refill a token per second, up to the burst
+	now = now.Add(500 * time.Millisecond)
+	require.False(t, rl.Allow(addr))
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, rl.Allow(addr))
+	require.False(t, rl.Allow(addr))
+	now = now.Add(time.Hour)
+	require.True(t, rl.Allow(addr))
+	require.True(t, rl.Allow(addr))
+	require.False(t, rl.Allow(addr))
+
+	// the same /64 shares the bucket
+	require.True(t, rl.Allow(netip.MustParseAddr("2001:db8::1")))
+	require.True(t, rl.Allow(netip.MustParseAddr("2001:db8::2")))
+	require.False(t, rl.Allow(netip.MustParseAddr("2001:db8::3")))
+	require.True(t, rl.Allow(netip.MustParseAddr("2001:db8:0:1::1")))
+}
+
+func TestRateLimiter_Evict(t *testing.T) {
+	rl := NewRateLimiter(0, 1, WithRateLimitEntries(2))
+	a, b, c := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")
+
+	require.True(t, rl.Allow(a))
+	require.True(t, rl.Allow(b))
+	require.False(t, rl.Allow(a)) // a is the most recently used
+	require.True(t, rl.Allow(c))  // b is evicted
+	require.Equal(t, 2, rl.lru.Len())
+	require.Len(t, rl.buckets, 2)
+
+	require.False(t, rl.Allow(a))
+	require.True(t, rl.Allow(b)) // c is evicted
+	require.True(t, rl.Allow(c)) // a is evicted
+	require.True(t, rl.Allow(a))
+}
+
+func TestRateLimiter_Concurrent(t *testing.T) {
+	rl := NewRateLimiter(0, 100)
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	var mu sync.Mutex
+	var allowed int
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if rl.Allow(addr) {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 100, allowed)
+}
+
+func TestListener_RateLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		behavior RejectBehavior
+	}{
+		{name: "close", behavior: RejectClose},
+		{name: "reset", behavior: RejectReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			var mu sync.Mutex
+			var postErrs []error
+			rl := NewRateLimiter(0, 1, WithRateLimitReject(tt.behavior))
+			pln := NewListener(ln, WithRateLimit(rl), WithPostReadHeader(func(h *Header, err error) {
+				mu.Lock()
+				postErrs = append(postErrs, err)
+				mu.Unlock()
+			}))
+			defer pln.Close()
+
+			dial := func(src string) net.Conn {
+				client, err := net.Dial("tcp", ln.Addr().String())
+				require.NoError(t, err)
+				t.Cleanup(func() { client.Close() })
+				_, err = client.Write([]byte("PROXY TCP4 " + src + " 10.0.0.1 56324 443\r\n"))
+				require.NoError(t, err)
+				return client
+			}
+
+			dial("192.0.2.1")
+			conn, err := pln.Accept()
+			require.NoError(t, err)
+			require.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+			conn.Close()
+
+			// the balancer is the same, but the real client is limited
+			limited := dial("192.0.2.1")
+			limited.SetReadDeadline(time.Now().Add(DefaultReadHeaderTimeout))
+			_, err = limited.Read(make([]byte, 1))
+			if tt.behavior == RejectReset {
+				require.Error(t, err)
+				require.NotErrorIs(t, err, io.EOF)
+				require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+			} else {
+				require.ErrorIs(t, err, io.EOF)
+			}
+
+			dial("192.0.2.2")
+			conn, err = pln.Accept()
+			require.NoError(t, err)
+			require.Equal(t, "192.0.2.2:56324", conn.RemoteAddr().String())
+			conn.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.Len(t, postErrs, 3)
+			require.ErrorIs(t, postErrs[1], ErrRateLimited)
+		})
+	}
+}
+
+func BenchmarkRateLimiter_Allow(b *testing.B) {
+	rl := NewRateLimiter(1e9, 1e9, WithRateLimitEntries(1024))
+	addrs := make([]netip.Addr, 4096)
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rl.Allow(addrs[i%len(addrs)])
+	}
+}
@@ -0,0 +1,241 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 protocol, see RFC 1928 and RFC 1929.
+const (
+	socks5Version         = 0x05
+	socks5UserPassVersion = 0x01
+
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xFF
+
+	socks5Connect = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+
+	socks5Succeeded        = 0x00
+	socks5GeneralFailure   = 0x01
+	socks5NotAllowed       = 0x02
+	socks5HostUnreachable  = 0x04
+	socks5ConnRefused      = 0x05
+	socks5CmdNotSupported  = 0x07
+	socks5AddrNotSupported = 0x08
+)
+
+var (
+	ErrSOCKS5Version     = errors.New("proxyproto socks5 unsupported version")
+	ErrSOCKS5Auth        = errors.New("proxyproto socks5 authentication failed")
+	ErrSOCKS5Command     = errors.New("proxyproto socks5 unsupported command")
+	ErrSOCKS5AddressType = errors.New("proxyproto socks5 unsupported address type")
+)
+
+// SOCKS5Server SOCKS5 front-end, it serves the CONNECT command only, dials the target
+// and sends the PROXY header of the client to it. it is an open proxy to any target by default,
+// restrict clients by WithTunnelAuth and targets by WithTunnelAllow.
+type SOCKS5Server struct {
+	tunnel tunnel
+}
+
+// NewSOCKS5Server create SOCKS5Server.
+func NewSOCKS5Server(opts ...TunnelOption) *SOCKS5Server {
+	return &SOCKS5Server{tunnel: newTunnel(opts...)}
+}
+
+// Serve accept connections and serve them until the listener is closed.
+// the listener may be a *Listener, so that the real client is sent to targets.
+func (s *SOCKS5Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serve a connection until the tunnel is done, the connection is closed then.
+// the negotiation, the request and dialing the target are limited by WithTunnelHandshakeTimeout.
+func (s *SOCKS5Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	ctx, cancel := s.tunnel.handshakeDeadline(context.Background(), conn)
+	defer cancel()
+
+	r := bufio.NewReader(conn)
+	user, err := s.negotiate(r, conn)
+	if err != nil {
+		return err
+	}
+	target, err := s.readRequest(r, conn)
+	if err != nil {
+		return err
+	}
+	if !s.tunnel.allowed(user, target) {
+		writeSOCKS5Reply(conn, socks5NotAllowed, nil)
+		return ErrTunnelNotAllowed
+	}
+
+	upstream, err := s.tunnel.dial(ctx, conn, user, target)
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5DialReply(err), nil)
+		return err
+	}
+	if err := writeSOCKS5Reply(conn, socks5Succeeded, upstream.LocalAddr()); err != nil {
+		upstream.Close()
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		upstream.Close()
+		return err
+	}
+	relay(conn, r, upstream)
+	return nil
+}
+
+// negotiate select the method, and authenticate the client if required, return the username.
+func (s *SOCKS5Server) negotiate(r *bufio.Reader, w io.Writer) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version {
+		return "", ErrSOCKS5Version
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	var method byte = socks5NoAuth
+	if s.tunnel.auth != nil {
+		method = socks5UserPass
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		w.Write([]byte{socks5Version, socks5NoAcceptable})
+		return "", ErrSOCKS5Auth
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5NoAuth {
+		return "", nil
+	}
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socks5UserPassVersion {
+		return "", ErrSOCKS5Version
+	}
+	user := make([]byte, head[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	password := make([]byte, n)
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", err
+	}
+	if !s.tunnel.auth(string(user), string(password)) {
+		w.Write([]byte{socks5UserPassVersion, 0x01})
+		return "", ErrSOCKS5Auth
+	}
+	if _, err := w.Write([]byte{socks5UserPassVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// readRequest read the request, return the target address.
+func (s *SOCKS5Server) readRequest(r *bufio.Reader, w io.Writer) (string, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version {
+		return "", ErrSOCKS5Version
+	}
+	if head[1] != socks5Connect {
+		writeSOCKS5Reply(w, socks5CmdNotSupported, nil)
+		return "", ErrSOCKS5Command
+	}
+
+	var host string
+	switch head[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == socks5IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5Domain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, n)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(w, socks5AddrNotSupported, nil)
+		return "", ErrSOCKS5AddressType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// writeSOCKS5Reply write the reply, the bound address is 0.0.0.0:0 unless addr is tcp.
+func writeSOCKS5Reply(w io.Writer, rep byte, addr net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr != nil {
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+
+	b := []byte{socks5Version, rep, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socks5IPv4), ip4...)
+	} else {
+		b = append(append(b, socks5IPv6), ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	_, err := w.Write(b)
+	return err
+}
+
+// socks5DialReply the reply of the dialing error.
+func socks5DialReply(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.As(err, &dnsErr):
+		return socks5HostUnreachable
+	}
+	return socks5GeneralFailure
+}
@@ -0,0 +1,232 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// connectSOCKS5 negotiate with the server, and request to connect the target, return the reply.
+func connectSOCKS5(conn net.Conn, r *bufio.Reader, user, password, target string) (byte, error) {
+	var method byte = socks5NoAuth
+	if user != "" {
+		method = socks5UserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return 0, err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	if b[1] != method {
+		return b[1], ErrSOCKS5Auth
+	}
+	if user != "" {
+		req := append([]byte{socks5UserPassVersion, byte(len(user))}, user...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		if b[1] != 0x00 {
+			return b[1], ErrSOCKS5Auth
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+	req := []byte{socks5Version, socks5Connect, 0x00}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(append(req, socks5IPv4), ip...)
+	} else {
+		req = append(append(req, socks5Domain, byte(len(host))), host...)
+	}
+	if _, err := conn.Write(append(req, byte(p>>8), byte(p))); err != nil {
+		return 0, err
+	}
+	var reply [10]byte
+	if _, err := io.ReadFull(r, reply[:]); err != nil {
+		return 0, err
+	}
+	return reply[1], nil
+}
+
+func newSOCKS5Front(t *testing.T, opts ...TunnelOption) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pln := NewListener(ln)
+	t.Cleanup(func() { pln.Close() })
+	go NewSOCKS5Server(opts...).Serve(pln)
+	return ln.Addr().String()
+}
+
+func TestSOCKS5Server(t *testing.T) {
+	backend := newTunnelBackend(t)
+	_, backendPort, _ := net.SplitHostPort(backend)
+	front := newSOCKS5Front(t,
+		WithTunnelAuth(func(user, password string) bool { return user == "alice" && password == "secret" }),
+		WithTunnelAllow(testAllow),
+		WithTunnelUserTLVs(testUserTLVs),
+	)
+
+	tests := []struct {
+		name     string
+		header   string
+		user     string
+		password string
+		target   string
+		wantRep  byte
+		wantErr  error
+		wantSrc  string
+	}{
+		{name: "ipv4", user: "alice", password: "secret", target: backend},
+		{name: "domain", user: "alice", password: "secret", target: net.JoinHostPort("localhost", backendPort)},
+		{
+			name: "real-client", header: "PROXY TCP4 192.0.2.60 192.0.2.1 56324 1080\r\n",
+			user: "alice", password: "secret", target: backend, wantSrc: "192.0.2.60:56324",
+		},
+		{name: "wrong-password", user: "alice", password: "guess", target: backend, wantRep: 0x01, wantErr: ErrSOCKS5Auth},
+		{name: "no-acceptable-method", target: backend, wantRep: socks5NoAcceptable, wantErr: ErrSOCKS5Auth},
+		{name: "connection-refused", user: "alice", password: "secret", target: closedAddr(t), wantRep: socks5ConnRefused},
+		{name: "not-allowed", user: "alice", password: "secret", target: "192.0.2.1:80", wantRep: socks5NotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", front)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = io.WriteString(conn, tt.header)
+			require.NoError(t, err)
+
+			r := bufio.NewReader(conn)
+			rep, err := connectSOCKS5(conn, r, tt.user, tt.password, tt.target)
+			require.Equal(t, tt.wantErr, err)
+			require.Equal(t, tt.wantRep, rep)
+			if rep != socks5Succeeded || err != nil {
+				return
+			}
+			src := tt.wantSrc
+			if src == "" {
+				src = conn.LocalAddr().String()
+			}
+			checkTunnel(t, conn, r, src, tt.user)
+		})
+	}
+}
+
+func TestSOCKS5Server_NoAuth(t *testing.T) {
+	backend := newTunnelBackend(t)
+	front := newSOCKS5Front(t, WithTunnelForward(WithForwardVersion(Version1)), WithTunnelUserTLVs(testUserTLVs))
+
+	conn, err := net.Dial("tcp", front)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	rep, err := connectSOCKS5(conn, r, "", "", backend)
+	require.NoError(t, err)
+	require.Equal(t, byte(socks5Succeeded), rep)
+	// no TLVs in version 1
+	checkTunnel(t, conn, r, conn.LocalAddr().String(), "")
+}
+
+func TestSOCKS5Server_ServeConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "version-4",
+			request: "\x04\x01\x00\x50\x7F\x00\x00\x01\x00",
+			wantErr: ErrSOCKS5Version,
+		},
+		{
+			name:    "bind",
+			request: "\x05\x01\x00" + "\x05\x02\x00\x01\x7F\x00\x00\x01\x00\x50",
+			want:    "\x05\x00" + "\x05\x07\x00\x01\x00\x00\x00\x00\x00\x00",
+			wantErr: ErrSOCKS5Command,
+		},
+		{
+			name:    "address-type",
+			request: "\x05\x01\x00" + "\x05\x01\x00\x02\x7F\x00\x00\x01\x00\x50",
+			want:    "\x05\x00" + "\x05\x08\x00\x01\x00\x00\x00\x00\x00\x00",
+			wantErr: ErrSOCKS5AddressType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			errc := make(chan error, 1)
+			go func() { errc <- NewSOCKS5Server().ServeConn(server) }()
+
+			go client.Write([]byte(tt.request))
+			got, _ := io.ReadAll(client)
+			require.Equal(t, tt.want, string(got))
+			require.Equal(t, tt.wantErr, <-errc)
+		})
+	}
+}
+
+// blockingDialer dial until ctx is done.
+type blockingDialer struct{}
+
+func (blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSOCKS5Server_HandshakeTimeout(t *testing.T) {
+	t.Run("idle-client", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		errc := make(chan error, 1)
+		go func() { errc <- NewSOCKS5Server(WithTunnelHandshakeTimeout(50 * time.Millisecond)).ServeConn(server) }()
+
+		// the request never comes after the negotiation
+		go client.Write([]byte("\x05\x01\x00"))
+		got, _ := io.ReadAll(client)
+		require.Equal(t, "\x05\x00", string(got))
+		require.ErrorIs(t, <-errc, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		front := newSOCKS5Front(t, WithTunnelDialer(blockingDialer{}), WithTunnelHandshakeTimeout(50*time.Millisecond))
+		conn, err := net.Dial("tcp", front)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		start := time.Now()
+		rep, err := connectSOCKS5(conn, bufio.NewReader(conn), "", "", "192.0.2.1:80")
+		require.NoError(t, err)
+		require.Equal(t, byte(socks5GeneralFailure), rep)
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("established", func(t *testing.T) {
+		backend := newTunnelBackend(t)
+		front := newSOCKS5Front(t, WithTunnelHandshakeTimeout(50*time.Millisecond))
+		conn, err := net.Dial("tcp", front)
+		require.NoError(t, err)
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		rep, err := connectSOCKS5(conn, r, "", "", backend)
+		require.NoError(t, err)
+		require.Equal(t, byte(socks5Succeeded), rep)
+
+		// the deadline is cleared for the tunnel
+		time.Sleep(100 * time.Millisecond)
+		checkTunnel(t, conn, r, conn.LocalAddr().String(), "")
+	})
+}
@@ -0,0 +1,21 @@
+module github.com/fango6/proxyproto/sshproxy
+
+go 1.25.0
+
+require (
+	github.com/fango6/proxyproto v0.0.0-20261018130705-10b6f34e3240
+	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.54.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/sirupsen/logrus v1.9.3 // indirect
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+	go.uber.org/zap v1.24.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
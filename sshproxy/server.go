@@ -0,0 +1,134 @@
+// Package sshproxy integrates the PROXY protocol with golang.org/x/crypto/ssh servers,
+// RemoteAddr of ssh.ConnMetadata is the real client, and callbacks of ssh.ServerConfig get the header.
+package sshproxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/fango6/proxyproto"
+	"golang.org/x/crypto/ssh"
+)
+
+// ServerConn ssh.ServerConn with the PROXY header.
+type ServerConn struct {
+	*ssh.ServerConn
+
+	// Header nil if the PROXY protocol is not used by the connection.
+	Header *proxyproto.Header
+}
+
+// NewServerConn read the PROXY header of conn, and then run ssh.NewServerConn.
+// RemoteAddr of ssh.ConnMetadata is the source address of header, and the callbacks of config,
+// such as PasswordCallback and PublicKeyCallback, can get the header by HeaderFromMetadata.
+// opts are applied to proxyproto.Conn, the timeout of reading header is proxyproto.DefaultReadHeaderTimeout
+// by default as proxyproto.Listener. the connections accepted by proxyproto.Listener are not wrapped again.
+func NewServerConn(conn net.Conn, config *ssh.ServerConfig, opts ...proxyproto.Option) (*ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	pc, ok := conn.(*proxyproto.Conn)
+	if !ok {
+		opts = append([]proxyproto.Option{proxyproto.WithReadHeaderTimeout(proxyproto.DefaultReadHeaderTimeout)}, opts...)
+		pc = proxyproto.NewConn(conn, opts...)
+	}
+	if err := pc.Handshake(context.Background()); err != nil {
+		pc.Close()
+		return nil, nil, nil, err
+	}
+
+	h := pc.Header()
+	if h != nil {
+		config = withHeader(config, h)
+	}
+	sc, chans, reqs, err := ssh.NewServerConn(pc, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &ServerConn{ServerConn: sc, Header: h}, chans, reqs, nil
+}
+
+// HeaderFromMetadata get the PROXY header of the connection, meta is ConnMetadata passed to
+// callbacks of ssh.ServerConfig while NewServerConn is in progress, or ServerConn it returned.
+func HeaderFromMetadata(meta ssh.ConnMetadata) (*proxyproto.Header, bool) {
+	var h *proxyproto.Header
+	switch m := meta.(type) {
+	case *ServerConn:
+		h = m.Header
+	case *connMetadata:
+		h = m.header
+	case *preAuthConn:
+		h = m.header
+	}
+	return h, h != nil
+}
+
+// connMetadata ssh.ConnMetadata with the PROXY header.
+type connMetadata struct {
+	ssh.ConnMetadata
+	header *proxyproto.Header
+}
+
+// preAuthConn ssh.ServerPreAuthConn with the PROXY header.
+type preAuthConn struct {
+	ssh.ServerPreAuthConn
+	header *proxyproto.Header
+}
+
+// withHeader copy config for a connection, its callbacks get ConnMetadata with h,
+// as ssh.NewServerConn copies config as well.
+func withHeader(config *ssh.ServerConfig, h *proxyproto.Header) *ssh.ServerConfig {
+	c := *config
+	wrap := func(meta ssh.ConnMetadata) ssh.ConnMetadata {
+		return &connMetadata{ConnMetadata: meta, header: h}
+	}
+
+	if fn := config.NoClientAuthCallback; fn != nil {
+		c.NoClientAuthCallback = func(meta ssh.ConnMetadata) (*ssh.Permissions, error) {
+			return fn(wrap(meta))
+		}
+	}
+	if fn := config.PasswordCallback; fn != nil {
+		c.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return fn(wrap(meta), password)
+		}
+	}
+	if fn := config.PublicKeyCallback; fn != nil {
+		c.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return fn(wrap(meta), key)
+		}
+	}
+	if fn := config.VerifiedPublicKeyCallback; fn != nil {
+		c.VerifiedPublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey, permissions *ssh.Permissions,
+			signatureAlgorithm string) (*ssh.Permissions, error) {
+			return fn(wrap(meta), key, permissions, signatureAlgorithm)
+		}
+	}
+	if fn := config.KeyboardInteractiveCallback; fn != nil {
+		c.KeyboardInteractiveCallback = func(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return fn(wrap(meta), client)
+		}
+	}
+	if fn := config.AuthLogCallback; fn != nil {
+		c.AuthLogCallback = func(meta ssh.ConnMetadata, method string, err error) {
+			fn(wrap(meta), method, err)
+		}
+	}
+	if fn := config.PreAuthConnCallback; fn != nil {
+		c.PreAuthConnCallback = func(conn ssh.ServerPreAuthConn) {
+			fn(&preAuthConn{ServerPreAuthConn: conn, header: h})
+		}
+	}
+	if fn := config.BannerCallback; fn != nil {
+		c.BannerCallback = func(meta ssh.ConnMetadata) string {
+			return fn(wrap(meta))
+		}
+	}
+	if gssapi := config.GSSAPIWithMICConfig; gssapi != nil && gssapi.AllowLogin != nil {
+		fn := gssapi.AllowLogin
+		c.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+			AllowLogin: func(meta ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+				return fn(wrap(meta), srcName)
+			},
+			Server: gssapi.Server,
+		}
+	}
+	return &c
+}
@@ -0,0 +1,278 @@
+package sshproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/fango6/proxyproto"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+func newTestHeader(tlvs ...proxyproto.TLV) *proxyproto.Header {
+	return &proxyproto.Header{
+		Version: proxyproto.Version2,
+		Command: proxyproto.CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+		DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22},
+		TLVs:    tlvs,
+	}
+}
+
+// serveOnce accept a connection of ln, and run NewServerConn.
+func serveOnce(t *testing.T, ln net.Listener, config *ssh.ServerConfig) <-chan *ServerConn {
+	conns := make(chan *ServerConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			conns <- nil
+			return
+		}
+		sc, chans, reqs, err := NewServerConn(conn, config)
+		if err != nil {
+			conns <- nil
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+		conns <- sc
+	}()
+	return conns
+}
+
+// dial send the header if h is not nil, and then authenticate.
+func dial(t *testing.T, addr string, h *proxyproto.Header, auth ssh.AuthMethod) error {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	if h != nil {
+		_, err = h.WriteTo(conn)
+		require.NoError(t, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            "audit",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return err
+	}
+	ssh.NewClient(c, chans, reqs).Close()
+	return nil
+}
+
+func TestNewServerConn(t *testing.T) {
+	var remoteAddrs []string
+	config := &ssh.ServerConfig{
+		// authorize by VPC endpoint
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			remoteAddrs = append(remoteAddrs, meta.RemoteAddr().String())
+			h, ok := HeaderFromMetadata(meta)
+			if !ok || h.VpceID() != "vpce-bastion" || string(password) != "secret" {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(newTestSigner(t))
+
+	tests := []struct {
+		name     string
+		h        *proxyproto.Header
+		wantAddr string
+		wantErr  bool
+	}{
+		{
+			name:     "allowed",
+			h:        newTestHeader(proxyproto.NewTLV(0xEA, []byte("\x01vpce-bastion"))),
+			wantAddr: "192.0.2.60:56324",
+		}, {
+			name:     "other-vpce",
+			h:        newTestHeader(proxyproto.NewTLV(0xEA, []byte("\x01vpce-other"))),
+			wantAddr: "192.0.2.60:56324",
+			wantErr:  true,
+		}, {
+			name:    "no-header",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+			conns := serveOnce(t, ln, config)
+			remoteAddrs = nil
+
+			err = dial(t, ln.Addr().String(), tt.h, ssh.Password("secret"))
+			sc := <-conns
+			require.Len(t, remoteAddrs, 1)
+			if tt.wantAddr != "" {
+				require.Equal(t, tt.wantAddr, remoteAddrs[0])
+			}
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Nil(t, sc)
+				return
+			}
+			require.NoError(t, err)
+			defer sc.Close()
+
+			require.Equal(t, tt.wantAddr, sc.RemoteAddr().String())
+			h, ok := HeaderFromMetadata(sc)
+			require.True(t, ok)
+			require.Equal(t, "vpce-bastion", h.VpceID())
+		})
+	}
+}
+
+func TestNewServerConn_Callbacks(t *testing.T) {
+	type record struct {
+		callback string
+		vpce     string
+	}
+	records := make(chan record, 64)
+	vpce := func(callback string, meta ssh.ConnMetadata) {
+		h, _ := HeaderFromMetadata(meta)
+		records <- record{callback: callback, vpce: h.VpceID()}
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			vpce("password", meta)
+			return nil, nil
+		},
+		AuthLogCallback: func(meta ssh.ConnMetadata, method string, err error) {
+			if method == "password" {
+				vpce("auth-log", meta)
+			}
+		},
+		BannerCallback: func(meta ssh.ConnMetadata) string {
+			vpce("banner", meta)
+			return ""
+		},
+		PreAuthConnCallback: func(conn ssh.ServerPreAuthConn) {
+			vpce("pre-auth", conn)
+		},
+	}
+	config.AddHostKey(newTestSigner(t))
+	password := config.PasswordCallback
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// concurrent connections get their own header
+	vpces := []string{"vpce-a", "vpce-b", "vpce-c"}
+	var wg sync.WaitGroup
+	for range vpces {
+		conns := serveOnce(t, ln, config)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sc := <-conns; sc != nil {
+				sc.Close()
+			}
+		}()
+	}
+	errs := make(chan error, len(vpces))
+	for _, v := range vpces {
+		h := newTestHeader(proxyproto.NewTLV(0xEA, append([]byte{0x01}, v...)))
+		go func() { errs <- dial(t, ln.Addr().String(), h, ssh.Password("secret")) }()
+	}
+	for range vpces {
+		require.NoError(t, <-errs)
+	}
+	wg.Wait()
+	close(records)
+
+	got := make(map[string][]string)
+	for r := range records {
+		got[r.callback] = append(got[r.callback], r.vpce)
+	}
+	for _, callback := range []string{"password", "auth-log", "banner", "pre-auth"} {
+		require.ElementsMatch(t, vpces, got[callback], callback)
+	}
+
+	// config is not modified
+	require.Equal(t, reflect.ValueOf(password).Pointer(), reflect.ValueOf(config.PasswordCallback).Pointer())
+}
+
+func TestNewServerConn_Listener(t *testing.T) {
+	signer := newTestSigner(t)
+	config := &ssh.ServerConfig{
+		// authorize by the authority and the real client
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			h, ok := HeaderFromMetadata(meta)
+			if !ok {
+				return nil, errors.New("no header")
+			}
+			tlv, _ := h.TLVs.Find(proxyproto.PP2_TYPE_AUTHORITY)
+			if string(tlv.Value) != "bastion.example.com" || meta.RemoteAddr().String() != "192.0.2.60:56324" {
+				return nil, errors.New("denied")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"authority": string(tlv.Value)}}, nil
+		},
+	}
+	config.AddHostKey(newTestSigner(t))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pln := proxyproto.NewListener(ln)
+	defer pln.Close()
+	conns := serveOnce(t, pln, config)
+
+	h := newTestHeader(proxyproto.NewTLV(proxyproto.PP2_TYPE_AUTHORITY, []byte("bastion.example.com")))
+	require.NoError(t, dial(t, ln.Addr().String(), h, ssh.PublicKeys(signer)))
+	sc := <-conns
+	require.NotNil(t, sc)
+	defer sc.Close()
+	require.Equal(t, "bastion.example.com", sc.Permissions.Extensions["authority"])
+	require.Equal(t, "192.0.2.60:56324", sc.RemoteAddr().String())
+}
+
+func TestNewServerConn_InvalidHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 invalid\r\n"))
+
+	_, _, _, err := NewServerConn(server, &ssh.ServerConfig{})
+	require.Error(t, err)
+
+	// the connection is closed
+	_, err = client.Write([]byte("SSH-2.0-Go\r\n"))
+	require.Error(t, err)
+}
+
+func TestHeaderFromMetadata(t *testing.T) {
+	_, ok := HeaderFromMetadata(nil)
+	require.False(t, ok)
+	_, ok = HeaderFromMetadata(&ServerConn{})
+	require.False(t, ok)
+	_, ok = HeaderFromMetadata(&connMetadata{})
+	require.False(t, ok)
+
+	h := newTestHeader()
+	got, ok := HeaderFromMetadata(&connMetadata{header: h})
+	require.True(t, ok)
+	require.Equal(t, h, got)
+	got, ok = HeaderFromMetadata(&preAuthConn{header: h})
+	require.True(t, ok)
+	require.Equal(t, h, got)
+}
@@ -0,0 +1,192 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+var ErrTemplateAddress = errors.New("formater template supports PROXY command over IPv4 or IPv6 only")
+
+// HeaderTemplate a header compiled once, whose source address is patched per connection.
+// the destination address, TLVs, padding and checksum layout stay constant.
+type HeaderTemplate struct {
+	version Version
+	af      AddressFamily
+	tp      TransportProtocol
+
+	// pp1: prefix + source IP + middle + source port + suffix
+	// pp2: raw with zeros in the source address and checksum fields
+	raw            []byte
+	middle         []byte
+	suffix         []byte
+	srcPortOffset  int
+	checksumOffset int // -1 if checksum is not present
+}
+
+// NewHeaderTemplate compile a template from the header, the source address of header is only a placeholder.
+// checksum is appended for pp2 if wantChecksum, and recomputed every time the template is formatted.
+func NewHeaderTemplate(h *Header, wantChecksum bool, opts ...FormatOption) (*HeaderTemplate, error) {
+	if err := checkHeaderToFormat(h); err != nil {
+		return nil, err
+	}
+	if h.Command != CMD_PROXY {
+		return nil, ErrTemplateAddress
+	}
+
+	switch h.Version {
+	case Version1:
+		return newV1Template(h)
+	case Version2:
+		return newV2Template(h, wantChecksum, mergeFormatOptions(opts...))
+	}
+	return nil, ErrUnknownVersion
+}
+
+func newV1Template(h *Header) (*HeaderTemplate, error) {
+	_, af, err := appendV1(nil, h)
+	if err != nil {
+		return nil, err
+	}
+	dstType := h.DstAddr.(*net.TCPAddr)
+	dstIP, _ := netip.AddrFromSlice(dstType.IP.To16())
+	if af == AF_INET {
+		dstIP = dstIP.Unmap()
+	}
+
+	t := &HeaderTemplate{version: Version1, af: af, tp: SOCK_STREAM, checksumOffset: -1}
+	t.raw = append(t.raw, v1Prefix...)
+	if af == AF_INET {
+		t.raw = append(t.raw, "TCP4 "...)
+	} else {
+		t.raw = append(t.raw, "TCP6 "...)
+	}
+	t.middle = append(t.middle, ' ')
+	t.middle = dstIP.AppendTo(t.middle)
+	t.middle = append(t.middle, ' ')
+	t.suffix = append(t.suffix, ' ')
+	t.suffix = strconv.AppendInt(t.suffix, int64(dstType.Port), 10)
+	t.suffix = append(t.suffix, "\r\n"...)
+	return t, nil
+}
+
+func newV2Template(h *Header, wantChecksum bool, o FormatOption) (*HeaderTemplate, error) {
+	raw, af, tp, err := appendV2(nil, h, wantChecksum, o)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &HeaderTemplate{version: Version2, af: af, tp: tp, raw: raw, checksumOffset: -1}
+	var srcIPLen int
+	switch af {
+	case AF_INET:
+		t.srcPortOffset, srcIPLen = 16+8, net.IPv4len
+	case AF_INET6:
+		t.srcPortOffset, srcIPLen = 16+32, net.IPv6len
+	default:
+		return nil, ErrTemplateAddress
+	}
+	// the placeholder is not kept
+	copy(raw[16:16+srcIPLen], make([]byte, srcIPLen))
+	binary.BigEndian.PutUint16(raw[t.srcPortOffset:], 0)
+
+	if wantChecksum {
+		t.checksumOffset = findCRC32cOffset(raw, 16+v2AddressLength(af))
+		if t.checksumOffset < 0 {
+			return nil, ErrMissingCRC32cChecksum
+		}
+		binary.BigEndian.PutUint32(raw[t.checksumOffset:], 0)
+	}
+	return t, nil
+}
+
+// findCRC32cOffset offset of the value of the first CRC-32c TLV, -1 if not found.
+func findCRC32cOffset(raw []byte, offset int) int {
+	for offset+3 <= len(raw) {
+		t := PP2Type(raw[offset])
+		l := int(binary.BigEndian.Uint16(raw[offset+1 : offset+3]))
+		offset += 3
+		if t == PP2_TYPE_CRC32C && l == 4 && offset+4 <= len(raw) {
+			return offset
+		}
+		offset += l
+	}
+	return -1
+}
+
+// Format format the header for the source address.
+func (t *HeaderTemplate) Format(src net.Addr) ([]byte, error) {
+	return t.AppendFormat(make([]byte, 0, t.size()), src)
+}
+
+// AppendFormat append the header for the source address to dst, and return the extended buffer.
+// the source address must be the same transport protocol and address family as the template,
+// dst is returned as it is if failed.
+func (t *HeaderTemplate) AppendFormat(dst []byte, src net.Addr) ([]byte, error) {
+	ip, port, err := t.source(src)
+	if err != nil {
+		return dst, err
+	}
+
+	if t.version == Version1 {
+		b := append(dst, t.raw...)
+		srcIP, _ := netip.AddrFromSlice(ip)
+		b = srcIP.AppendTo(b)
+		b = append(b, t.middle...)
+		b = strconv.AppendInt(b, int64(port), 10)
+		return append(b, t.suffix...), nil
+	}
+
+	var start = len(dst)
+	b := append(dst, t.raw...)
+	copy(b[start+16:], ip)
+	binary.BigEndian.PutUint16(b[start+t.srcPortOffset:], uint16(port))
+	if t.checksumOffset >= 0 {
+		binary.BigEndian.PutUint32(b[start+t.checksumOffset:], crc32.Checksum(b[start:], crc32cTab))
+	}
+	return b, nil
+}
+
+// source convert the source address to IP and port of the template.
+func (t *HeaderTemplate) source(src net.Addr) (net.IP, int, error) {
+	var ip net.IP
+	var port int
+	switch addr := src.(type) {
+	case *net.TCPAddr:
+		if addr == nil || t.tp != SOCK_STREAM {
+			return nil, 0, ErrInvalidAddress
+		}
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		if addr == nil || t.tp != SOCK_DGRAM {
+			return nil, 0, ErrInvalidAddress
+		}
+		ip, port = addr.IP, addr.Port
+	default:
+		return nil, 0, ErrInvalidAddress
+	}
+	if validatePort(port) != nil {
+		return nil, 0, ErrInvalidAddress
+	}
+
+	if t.af == AF_INET {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil {
+		return nil, 0, ErrInvalidAddress
+	}
+	return ip, port, nil
+}
+
+// size the maximum length of formatted header.
+func (t *HeaderTemplate) size() int {
+	if t.version == Version1 {
+		return len(t.raw) + len(t.middle) + len(t.suffix) + 39 + 5 // IPv6 and port in text at most
+	}
+	return len(t.raw)
+}
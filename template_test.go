@@ -0,0 +1,210 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var headerTemplateTests = []struct {
+	name         string
+	h            *Header
+	wantChecksum bool
+	opts         []FormatOption
+	srcs         []net.Addr
+}{
+	{
+		name: "v1-tcp4",
+		h: &Header{
+			Version: Version1,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4zero},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+		},
+		srcs: []net.Addr{
+			&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 0},
+		},
+	}, {
+		name: "v1-tcp6",
+		h: &Header{
+			Version: Version1,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv6zero},
+			DstAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		srcs: []net.Addr{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"), Port: 65535},
+		},
+	}, {
+		name: "v2-tcp4",
+		h: &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4zero},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+		},
+		srcs: []net.Addr{
+			&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		},
+	}, {
+		name: "v2-tcp4-tlv-checksum",
+		h: &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.TCPAddr{IP: net.IPv4zero},
+			DstAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+			TLVs:    TLVs{NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com"))},
+		},
+		wantChecksum: true,
+		opts:         []FormatOption{WithPaddingAlign(64)},
+		srcs: []net.Addr{
+			&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		},
+	}, {
+		name: "v2-udp6-checksum",
+		h: &Header{
+			Version: Version2,
+			Command: CMD_PROXY,
+			SrcAddr: &net.UDPAddr{IP: net.IPv6zero},
+			DstAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53},
+		},
+		wantChecksum: true,
+		srcs: []net.Addr{
+			&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		},
+	},
+}
+
+func TestHeaderTemplate(t *testing.T) {
+	for _, tt := range headerTemplateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := NewHeaderTemplate(tt.h, tt.wantChecksum, tt.opts...)
+			require.NoError(t, err)
+			if tmpl.version == Version2 {
+				// the placeholder is not kept
+				srcIPLen := net.IPv4len
+				if tmpl.af == AF_INET6 {
+					srcIPLen = net.IPv6len
+				}
+				require.Equal(t, make([]byte, srcIPLen), tmpl.raw[16:16+srcIPLen])
+				require.Equal(t, []byte{0, 0}, tmpl.raw[tmpl.srcPortOffset:tmpl.srcPortOffset+2])
+			}
+
+			var buf []byte
+			for _, src := range tt.srcs {
+				buf, err = tmpl.AppendFormat(buf[:0], src)
+				require.NoError(t, err)
+
+				h := *tt.h
+				h.SrcAddr = src
+				want, err := formatHeader(&h, tt.wantChecksum, tt.opts...)
+				require.NoError(t, err)
+				require.Equal(t, want, buf)
+
+				got, err := ReadHeader(bufio.NewReader(bytes.NewReader(buf)))
+				require.NoError(t, err)
+				require.Equal(t, tt.wantChecksum, got.ChecksumVerified)
+
+				formatted, err := tmpl.Format(src)
+				require.NoError(t, err)
+				require.Equal(t, want, formatted)
+			}
+		})
+	}
+}
+
+func TestHeaderTemplate_Errors(t *testing.T) {
+	v4 := &Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4zero},
+		DstAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+	}
+	tmpl, err := NewHeaderTemplate(v4, false)
+	require.NoError(t, err)
+
+	var dst = []byte("prefix")
+	for _, src := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+		&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 65536},
+		(*net.TCPAddr)(nil),
+		nil,
+	} {
+		got, err := tmpl.AppendFormat(dst, src)
+		require.EqualError(t, err, ErrInvalidAddress.Error())
+		require.Equal(t, dst, got)
+	}
+
+	_, err = NewHeaderTemplate(&Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.UnixAddr{Net: "unix", Name: "@client"},
+		DstAddr: &net.UnixAddr{Net: "unix", Name: "/var/run/app.sock"},
+	}, false)
+	require.EqualError(t, err, ErrTemplateAddress.Error())
+
+	_, err = NewHeaderTemplate(&Header{
+		Version: Version2,
+		Command: CMD_LOCAL,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4zero},
+		DstAddr: &net.TCPAddr{IP: net.IPv4zero},
+	}, false)
+	require.EqualError(t, err, ErrTemplateAddress.Error())
+}
+
+func TestHeaderTemplate_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are instrumented by the race detector")
+	}
+	var buf = make([]byte, 0, 1024)
+	for _, tt := range headerTemplateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := NewHeaderTemplate(tt.h, tt.wantChecksum, tt.opts...)
+			require.NoError(t, err)
+			allocs := testing.AllocsPerRun(100, func() {
+				if _, err := tmpl.AppendFormat(buf[:0], tt.srcs[0]); err != nil {
+					t.Fatal(err)
+				}
+			})
+			require.Zero(t, allocs)
+		})
+	}
+}
+
+func BenchmarkHeaderTemplate(b *testing.B) {
+	var buf = make([]byte, 0, 1024)
+	for _, tt := range headerTemplateTests {
+		tmpl, err := NewHeaderTemplate(tt.h, tt.wantChecksum, tt.opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		h := *tt.h
+		h.SrcAddr = tt.srcs[0]
+
+		b.Run(tt.name+"/template", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := tmpl.AppendFormat(buf[:0], tt.srcs[0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(tt.name+"/append-format", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := appendHeader(buf[:0], &h, tt.wantChecksum, tt.opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package proxyproto
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// TLSListener accept TLS connections behind the PROXY protocol, the header is read
+// before the TLS handshake, so that GetConfigForClient of tls.Config can see it.
+type TLSListener struct {
+	*Listener
+	config *tls.Config
+}
+
+// NewTLSListener create TLSListener, opts are applied to every Conn as NewListener does.
+func NewTLSListener(ln net.Listener, config *tls.Config, opts ...Option) *TLSListener {
+	return &TLSListener{
+		Listener: NewListener(ln, opts...),
+		config:   config,
+	}
+}
+
+// Accept accept a connection, and return *tls.Conn over *Conn, so that net/http sets
+// Request.TLS and negotiates HTTP/2 as it does with tls.NewListener.
+// neither the header nor the TLS handshake is finished yet unless policies are enforced,
+// they are done by the first Read, Write or HandshakeContext, whose ctx bounds both.
+// the timeout of reading header applies to the header only, get the header by HeaderFromTLSConn.
+func (ln *TLSListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, ln.config), nil
+}
+
+// HeaderFromTLSConn get the PROXY header of a connection accepted by TLSListener,
+// it will wait for reading header but not the TLS handshake.
+// nil if the connection is not over Conn or has no header.
+func HeaderFromTLSConn(conn *tls.Conn) *Header {
+	if conn == nil {
+		return nil
+	}
+	pc := findConn(conn.NetConn())
+	if pc == nil {
+		return nil
+	}
+	return pc.Header()
+}
+
+// HeaderFromClientHello get the PROXY header of the connection in GetConfigForClient
+// or GetCertificate of tls.Config, nil if the connection is not Conn or has no header.
+func HeaderFromClientHello(hello *tls.ClientHelloInfo) *Header {
+	if hello == nil {
+		return nil
+	}
+	pc := findConn(hello.Conn)
+	if pc == nil {
+		return nil
+	}
+	return pc.Header()
+}
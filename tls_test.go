@@ -0,0 +1,206 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificate(t testing.TB, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSListener(t *testing.T) {
+	certs := map[string]tls.Certificate{
+		"vpce-a": newTestCertificate(t, "a.example.com"),
+		"vpce-b": newTestCertificate(t, "b.example.com"),
+	}
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, ok := certs[HeaderFromClientHello(hello).VpceID()]
+			if !ok {
+				cert = newTestCertificate(t, "default.example.com")
+			}
+			return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tln := NewTLSListener(ln, config)
+	defer tln.Close()
+
+	for _, vpce := range []string{"vpce-a", "vpce-b", "vpce-c"} {
+		t.Run(vpce, func(t *testing.T) {
+			done := make(chan string, 1)
+			go func() {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					done <- err.Error()
+					return
+				}
+				defer conn.Close()
+				h := &Header{
+					Version: Version2,
+					Command: CMD_PROXY,
+					SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+					DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+					TLVs:    TLVs{NewTLV(0xEA, append([]byte{0x01}, vpce...))},
+				}
+				if _, err := h.WriteTo(conn); err != nil {
+					done <- err.Error()
+					return
+				}
+				client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+				if err := client.Handshake(); err != nil {
+					done <- err.Error()
+					return
+				}
+				client.Write([]byte("hello"))
+				done <- client.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}()
+
+			conn, err := tln.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+			tc := conn.(*tls.Conn)
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(tc, buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf))
+
+			require.True(t, tc.ConnectionState().HandshakeComplete)
+			require.Equal(t, vpce, HeaderFromTLSConn(tc).VpceID())
+			require.Equal(t, "192.0.2.60:56324", tc.RemoteAddr().String())
+			require.NotNil(t, findConn(tc))
+
+			want := map[string]string{"vpce-a": "a.example.com", "vpce-b": "b.example.com"}[vpce]
+			if want == "" {
+				want = "default.example.com"
+			}
+			require.Equal(t, want, <-done)
+		})
+	}
+}
+
+func TestTLSListener_HandshakeContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t, "example.com")}}
+	tln := NewTLSListener(ln, config, WithReadHeaderTimeout(time.Second))
+	defer tln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the header arrives, but no ClientHello follows it
+	_, err = client.Write([]byte("PROXY TCP4 192.0.2.60 192.0.2.1 56324 443\r\n"))
+	require.NoError(t, err)
+
+	conn, err := tln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	tc := conn.(*tls.Conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = tc.HandshakeContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, "192.0.2.60:56324", HeaderFromTLSConn(tc).SrcAddr.String())
+}
+
+func TestTLSListener_HTTPServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "example.com")},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	tln := NewTLSListener(ln, config)
+
+	type headerKey struct{}
+	srv := &http.Server{
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, headerKey{}, HeaderFromTLSConn(c.(*tls.Conn)))
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h, _ := r.Context().Value(headerKey{}).(*Header)
+			if r.TLS == nil || h == nil {
+				http.Error(w, "no TLS or header", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "%s %s %s", r.Proto, r.RemoteAddr, h.SrcAddr)
+		}),
+	}
+	go srv.Serve(tln)
+	defer srv.Close()
+
+	h := &Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+		DstAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := h.WriteTo(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get("https://" + ln.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.Equal(t, "HTTP/2.0 192.0.2.60:56324 192.0.2.60:56324", string(body))
+}
+
+func TestHeaderFromClientHello(t *testing.T) {
+	require.Nil(t, HeaderFromClientHello(nil))
+	require.Nil(t, HeaderFromTLSConn(nil))
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	require.Nil(t, HeaderFromClientHello(&tls.ClientHelloInfo{Conn: server}))
+	require.Nil(t, HeaderFromTLSConn(tls.Server(server, &tls.Config{})))
+}
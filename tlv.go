@@ -26,6 +26,13 @@ const (
 	PP2_TYPE_NETNS          PP2Type = 0x30
 )
 
+// The client field of PP2_TYPE_SSL is made of the following bit fields:
+const (
+	PP2_CLIENT_SSL       byte = 0x01
+	PP2_CLIENT_CERT_CONN byte = 0x02
+	PP2_CLIENT_CERT_SESS byte = 0x04
+)
+
 // TLV a Type-Length-Value group
 type TLV struct {
 	Type   PP2Type
@@ -41,6 +48,7 @@ var (
 	ErrTlvValTooShort = errors.New("TLV's values are too short")
 )
 
+// parseTLVs parse TLV groups.
 func parseTLVs(rawTLVs []byte) (TLVs, error) {
 	var tlvs TLVs
 	var rawLen = len(rawTLVs)
@@ -86,20 +94,38 @@ func NewNoOpTLV(length uint16) TLV {
 
 // Format format to raw bytes for PROXY sender.
 func (tlv TLV) Format() []byte {
+	l := tlv.formatLength()
+	if l == 0 {
+		return nil
+	}
+	return tlv.AppendFormat(make([]byte, 0, l))
+}
+
+// AppendFormat append the formatted TLV to dst, and return the extended buffer.
+// a NOOP without values is filled with zeros of its length.
+func (tlv TLV) AppendFormat(dst []byte) []byte {
 	l := len(tlv.Value)
-	// not values
 	if l == 0 {
-		// no-op
 		if tlv.Type == PP2_TYPE_NOOP && tlv.Length > 0 {
-			return make([]byte, tlv.Length)
+			dst = append(dst, byte(tlv.Type), byte(tlv.Length>>8), byte(tlv.Length))
+			return append(dst, make([]byte, tlv.Length)...)
 		}
-		return nil
+		return dst
 	}
 
-	var buf = make([]byte, 0, l)
-	buf = append(buf, byte(tlv.Type), byte(l>>8), byte(l))
-	buf = append(buf, tlv.Value...)
-	return buf
+	dst = append(dst, byte(tlv.Type), byte(l>>8), byte(l))
+	return append(dst, tlv.Value...)
+}
+
+// formatLength length of the formatted TLV, 0 if nothing is formatted.
+func (tlv TLV) formatLength() int {
+	if l := len(tlv.Value); l > 0 {
+		return 3 + l
+	}
+	if tlv.Type == PP2_TYPE_NOOP && tlv.Length > 0 {
+		return 3 + int(tlv.Length)
+	}
+	return 0
 }
 
 // IsRegistered true if type have already been registered
@@ -142,3 +168,68 @@ func (s TLVs) String() string {
 	}
 	return strings.Join(fields, ",")
 }
+
+// Find the first TLV of the type.
+func (s TLVs) Find(typ PP2Type) (TLV, bool) {
+	for _, tlv := range s {
+		if tlv.Type == typ {
+			return tlv, true
+		}
+	}
+	return TLV{}, false
+}
+
+// SSL the value of PP2_TYPE_SSL, the client connected over SSL/TLS.
+type SSL struct {
+	Client byte   // bit fields of PP2_CLIENT_SSL, PP2_CLIENT_CERT_CONN and PP2_CLIENT_CERT_SESS
+	Verify uint32 // zero if the client certificate was verified successfully
+	TLVs   TLVs   // sub-TLVs, such as PP2_SUBTYPE_SSL_VERSION
+}
+
+// ParseSSL parse the value of PP2_TYPE_SSL.
+func ParseSSL(tlv TLV) (SSL, error) {
+	if tlv.Type != PP2_TYPE_SSL {
+		return SSL{}, errors.New("TLV's type is not PP2_TYPE_SSL")
+	}
+	if len(tlv.Value) < 5 {
+		return SSL{}, ErrTlvValTooShort
+	}
+
+	subTLVs, err := parseTLVs(tlv.Value[5:])
+	if err != nil {
+		return SSL{}, err
+	}
+	return SSL{
+		Client: tlv.Value[0],
+		Verify: binary.BigEndian.Uint32(tlv.Value[1:5]),
+		TLVs:   subTLVs,
+	}, nil
+}
+
+// TLV format to a PP2_TYPE_SSL TLV.
+func (s SSL) TLV() TLV {
+	var val = make([]byte, 5)
+	val[0] = s.Client
+	binary.BigEndian.PutUint32(val[1:], s.Verify)
+	for _, tlv := range s.TLVs {
+		val = tlv.AppendFormat(val)
+	}
+	return NewTLV(PP2_TYPE_SSL, val)
+}
+
+// ClientSSL true if the client connected over SSL/TLS.
+func (s SSL) ClientSSL() bool {
+	return s.Client&PP2_CLIENT_SSL != 0
+}
+
+// Version the SSL/TLS version, such as TLSv1.3.
+func (s SSL) Version() string {
+	tlv, _ := s.TLVs.Find(PP2_SUBTYPE_SSL_VERSION)
+	return string(tlv.Value)
+}
+
+// CN the common name of the client certificate.
+func (s SSL) CN() string {
+	tlv, _ := s.TLVs.Find(PP2_SUBTYPE_SSL_CN)
+	return string(tlv.Value)
+}
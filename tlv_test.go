@@ -45,3 +45,30 @@ func Test_parseTLVs(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSSL(t *testing.T) {
+	ssl := SSL{
+		Client: PP2_CLIENT_SSL | PP2_CLIENT_CERT_CONN,
+		Verify: 0,
+		TLVs: TLVs{
+			NewTLV(PP2_SUBTYPE_SSL_VERSION, []byte("TLSv1.3")),
+			NewTLV(PP2_SUBTYPE_SSL_CN, []byte("client.example.com")),
+		},
+	}
+	tlv := ssl.TLV()
+	require.Equal(t, PP2_TYPE_SSL, tlv.Type)
+
+	got, err := ParseSSL(tlv)
+	require.NoError(t, err)
+	require.Equal(t, ssl, got)
+	require.True(t, got.ClientSSL())
+	require.Equal(t, "TLSv1.3", got.Version())
+	require.Equal(t, "client.example.com", got.CN())
+
+	_, err = ParseSSL(NewTLV(PP2_TYPE_SSL, []byte{0x01}))
+	require.EqualError(t, err, ErrTlvValTooShort.Error())
+	_, err = ParseSSL(NewTLV(PP2_TYPE_SSL, []byte{0x01, 0, 0, 0, 0, 0x21, 0x00}))
+	require.EqualError(t, err, ErrTlvLenTooShort.Error())
+	_, err = ParseSSL(NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com")))
+	require.Error(t, err)
+}
@@ -0,0 +1,252 @@
+package proxyproto
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTransportClients = 1024
+)
+
+var ErrNoClientAddress = errors.New("proxyproto client address of the request is unknown")
+
+// TransportOption option of Transport.
+type TransportOption func(*Transport)
+
+// WithBaseTransport the transport cloned for backends, a clone of http.DefaultTransport by default.
+// its Proxy, DialTLSContext and DialTLS are dropped, so that headers reach backends first.
+func WithBaseTransport(base *http.Transport) TransportOption {
+	return func(t *Transport) {
+		t.base = base.Clone()
+	}
+}
+
+// WithTransportForward how headers are built, see HeaderFromConn.
+func WithTransportForward(opts ...ForwardOption) TransportOption {
+	return func(t *Transport) {
+		t.forward = append(t.forward, opts...)
+	}
+}
+
+// WithTransportClient options of ClientConn to backends.
+func WithTransportClient(opts ...ClientOption) TransportOption {
+	return func(t *Transport) {
+		t.clientOptions = append(t.clientOptions, opts...)
+	}
+}
+
+// WithTransportClients the max number of clients whose connections are pooled,
+// idle connections of the least recently used client are closed beyond it.
+func WithTransportClients(n int) TransportOption {
+	return func(t *Transport) {
+		if n > 0 {
+			t.maxClients = n
+		}
+	}
+}
+
+// WithTransportDisableReuse dial a connection for every request, instead of pooling per client.
+func WithTransportDisableReuse() TransportOption {
+	return func(t *Transport) {
+		t.disableReuse = true
+	}
+}
+
+// Transport http.RoundTripper sending PROXY headers of clients to backends, such as the Transport of
+// httputil.ReverseProxy. connections to backends are pooled per client, so that they are never shared.
+// the client is the connection stored by ConnContext if any, whose PROXY header is carried over,
+// otherwise RemoteAddr of the request. set ConnState of http.Server to Transport.ConnState,
+// so that connections of a client are closed once it disconnects.
+type Transport struct {
+	base          *http.Transport
+	forward       []ForwardOption
+	clientOptions []ClientOption
+	maxClients    int
+	disableReuse  bool
+
+	mu     sync.Mutex
+	pools  map[interface{}]*list.Element
+	lru    *list.List // front is the most recently used
+	single *http.Transport
+}
+
+// clientPool connections of a client, key is the incoming connection or RemoteAddr of requests.
+type clientPool struct {
+	key       interface{}
+	transport *http.Transport
+}
+
+// forwardSource the client of request, carried by the context of dialing.
+type forwardSource struct {
+	src      net.Addr
+	upstream *Header
+}
+
+type forwardSourceContextKey struct{}
+
+type connContextKey struct{}
+
+// ConnContext store the connection in the context, used as ConnContext of http.Server,
+// so that Transport carries over the PROXY header of the incoming connection.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// NewTransport create Transport.
+func NewTransport(opts ...TransportOption) *Transport {
+	t := &Transport{
+		maxClients: defaultTransportClients,
+		pools:      make(map[interface{}]*list.Element),
+		lru:        list.New(),
+	}
+	for _, o := range opts {
+		o(t)
+	}
+	if t.base == nil {
+		t.base = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	t.base.Proxy = nil
+	t.base.DialTLSContext = nil
+	t.base.DialTLS = nil
+	return t
+}
+
+// RoundTrip implement http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, source, err := clientSource(req)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), forwardSourceContextKey{}, source))
+	if t.disableReuse {
+		return t.singleTransport().RoundTrip(req)
+	}
+	return t.clientTransport(key).RoundTrip(req)
+}
+
+// CloseIdleConnections close idle connections of all clients.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*clientPool).transport.CloseIdleConnections()
+	}
+	if t.single != nil {
+		t.single.CloseIdleConnections()
+	}
+}
+
+// ConnState drop the connections of the client once its connection is closed or hijacked,
+// used as ConnState of http.Server. otherwise they are dropped only beyond WithTransportClients.
+// idle connections are closed at once, the busy ones once they are idle.
+func (t *Transport) ConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// keyed by the connection stored by ConnContext, or RemoteAddr of requests
+	t.dropClient(c)
+	t.dropClient(c.RemoteAddr().String())
+}
+
+// clientSource the client of request, and the key of its pool.
+func clientSource(req *http.Request) (interface{}, forwardSource, error) {
+	if conn, ok := req.Context().Value(connContextKey{}).(net.Conn); ok {
+		var upstream *Header
+		if pc := findConn(conn); pc != nil {
+			if err := pc.readHeader(); err != nil {
+				return nil, forwardSource{}, err
+			}
+			upstream = pc.Header()
+		}
+		return conn, forwardSource{src: conn.RemoteAddr(), upstream: upstream}, nil
+	}
+
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return nil, forwardSource{}, ErrNoClientAddress
+	}
+	return req.RemoteAddr, forwardSource{src: net.TCPAddrFromAddrPort(ap)}, nil
+}
+
+// clientTransport the transport of the client, the least recently used is evicted beyond the max.
+func (t *Transport) clientTransport(key interface{}) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.pools[key]; ok {
+		t.lru.MoveToFront(e)
+		return e.Value.(*clientPool).transport
+	}
+
+	pool := &clientPool{key: key, transport: t.newTransport()}
+	t.pools[key] = t.lru.PushFront(pool)
+	for t.lru.Len() > t.maxClients {
+		t.dropClient(t.lru.Back().Value.(*clientPool).key)
+	}
+	return pool.transport
+}
+
+// dropClient remove the pool of the client and close its idle connections, t.mu must be held.
+// http.Transport closes the connections getting idle later as well.
+func (t *Transport) dropClient(key interface{}) {
+	e, ok := t.pools[key]
+	if !ok {
+		return
+	}
+	t.lru.Remove(e)
+	delete(t.pools, key)
+	e.Value.(*clientPool).transport.CloseIdleConnections()
+}
+
+func (t *Transport) singleTransport() *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.single == nil {
+		t.single = t.newTransport()
+		t.single.DisableKeepAlives = true
+	}
+	return t.single
+}
+
+func (t *Transport) newTransport() *http.Transport {
+	transport := t.base.Clone()
+	dial := t.base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		source, ok := ctx.Value(forwardSourceContextKey{}).(forwardSource)
+		if !ok {
+			return nil, ErrNoClientAddress
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		h, err := forwardHeader(source.src, conn.RemoteAddr(), source.upstream, t.forward...)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cc, err := NewClientConn(conn, h, t.clientOptions...)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return cc, nil
+	}
+	return transport
+}
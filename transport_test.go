@@ -0,0 +1,222 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newBackend serve HTTP behind the PROXY protocol, it responds the real client and the authority TLV.
+// conns and closed count the connections accepted and closed.
+func newBackend(t *testing.T) (addr string, conns, closed *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conns, closed = new(int32), new(int32)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn := r.Context().Value(connContextKey{}).(net.Conn)
+			h := findConn(conn).Header()
+			if h == nil {
+				http.Error(w, "no PROXY header", http.StatusBadRequest)
+				return
+			}
+			tlv, _ := h.TLVs.Find(PP2_TYPE_AUTHORITY)
+			io.WriteString(w, r.RemoteAddr+" "+string(tlv.Value))
+		}),
+		ConnContext: ConnContext,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				atomic.AddInt32(conns, 1)
+			case http.StateClosed:
+				atomic.AddInt32(closed, 1)
+			}
+		},
+	}
+	go srv.Serve(NewListener(ln))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String(), conns, closed
+}
+
+func roundTrip(t *testing.T, rt http.RoundTripper, backend, remoteAddr string) string {
+	req, err := http.NewRequest(http.MethodGet, "http://"+backend+"/", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = remoteAddr
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	return string(body)
+}
+
+func TestTransport(t *testing.T) {
+	backend, conns, _ := newBackend(t)
+	tr := NewTransport()
+	defer tr.CloseIdleConnections()
+
+	require.Equal(t, "192.0.2.60:1000 ", roundTrip(t, tr, backend, "192.0.2.60:1000"))
+	require.Equal(t, "192.0.2.60:1000 ", roundTrip(t, tr, backend, "192.0.2.60:1000"))
+	require.Equal(t, "[2001:db8::1]:2000 ", roundTrip(t, tr, backend, "[2001:db8::1]:2000"))
+	require.Equal(t, "192.0.2.60:1000 ", roundTrip(t, tr, backend, "192.0.2.60:1000"))
+	// connections are reused by the same client only
+	require.EqualValues(t, 2, atomic.LoadInt32(conns))
+
+	t.Run("no-client-address", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+backend+"/", nil)
+		require.NoError(t, err)
+		_, err = tr.RoundTrip(req)
+		require.ErrorIs(t, err, ErrNoClientAddress)
+	})
+}
+
+func TestTransport_DisableReuse(t *testing.T) {
+	backend, conns, _ := newBackend(t)
+	tr := NewTransport(WithTransportDisableReuse(), WithTransportForward(WithForwardVersion(Version1)))
+	defer tr.CloseIdleConnections()
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, "192.0.2.60:1000 ", roundTrip(t, tr, backend, "192.0.2.60:1000"))
+	}
+	require.EqualValues(t, 3, atomic.LoadInt32(conns))
+}
+
+func TestTransport_Evict(t *testing.T) {
+	backend, conns, _ := newBackend(t)
+	tr := NewTransport(WithTransportClients(1))
+	defer tr.CloseIdleConnections()
+
+	roundTrip(t, tr, backend, "192.0.2.60:1000")
+	roundTrip(t, tr, backend, "192.0.2.61:1000")
+	roundTrip(t, tr, backend, "192.0.2.60:1000")
+	require.EqualValues(t, 3, atomic.LoadInt32(conns))
+	require.Equal(t, 1, tr.lru.Len())
+	require.Len(t, tr.pools, 1)
+}
+
+func TestTransport_HTTP2(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "example.com")},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	var conns int32
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Proto, r.RemoteAddr)
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		},
+	}
+	go srv.Serve(NewTLSListener(ln, config))
+	defer srv.Close()
+
+	tr := NewTransport(WithBaseTransport(&http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}))
+	defer tr.CloseIdleConnections()
+
+	for _, client := range []string{"192.0.2.60:1000", "192.0.2.60:1000", "[2001:db8::1]:2000", "192.0.2.60:1000"} {
+		req, err := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+"/", nil)
+		require.NoError(t, err)
+		req.RemoteAddr = client
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		require.Equal(t, "HTTP/2.0 "+client, string(body))
+	}
+	// streams of a client are multiplexed on its own connection, never on the ones of others
+	require.EqualValues(t, 2, atomic.LoadInt32(&conns))
+}
+
+func TestTransport_ReverseProxy(t *testing.T) {
+	backend, _, _ := newBackend(t)
+	target, err := url.Parse("http://" + backend)
+	require.NoError(t, err)
+
+	// the front proxy carries over the authority of the incoming header
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = NewTransport(WithTransportForward(WithForwardTLVs(PP2_TYPE_AUTHORITY)))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	front := &http.Server{Handler: proxy, ConnContext: ConnContext}
+	go front.Serve(NewListener(ln))
+	defer front.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: (&Dialer{}).DialContext,
+	}}
+	defer client.CloseIdleConnections()
+	ctx := ContextWithHeader(context.Background(), &Header{
+		Version: Version2,
+		Command: CMD_PROXY,
+		SrcAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 60), Port: 56324},
+		TLVs:    TLVs{NewTLV(PP2_TYPE_AUTHORITY, []byte("example.com"))},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ln.Addr().String()+"/", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.Equal(t, "192.0.2.60:56324 example.com", strings.TrimSpace(string(body)))
+}
+
+func TestTransport_ConnState(t *testing.T) {
+	backend, conns, closed := newBackend(t)
+	target, err := url.Parse("http://" + backend)
+	require.NoError(t, err)
+
+	tr := NewTransport()
+	defer tr.CloseIdleConnections()
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = tr
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	front := &http.Server{Handler: proxy, ConnContext: ConnContext, ConnState: tr.ConnState}
+	go front.Serve(ln)
+	defer front.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://" + ln.Addr().String() + "/")
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(conns))
+	require.Zero(t, atomic.LoadInt32(closed))
+
+	// the client disconnects, so does the connection to the backend
+	client.CloseIdleConnections()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(closed) == 1
+	}, time.Second, 10*time.Millisecond)
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	require.Zero(t, tr.lru.Len())
+	require.Empty(t, tr.pools)
+}
@@ -0,0 +1,156 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	defaultTunnelHandshakeTimeout = time.Second * 30
+)
+
+var ErrTunnelNotAllowed = errors.New("proxyproto tunnel target is not allowed")
+
+// TunnelOption option of SOCKS5Server and ConnectHandler.
+type TunnelOption func(*tunnel)
+
+// WithTunnelDialer dial targets with the dialer, *net.Dialer by default.
+func WithTunnelDialer(d ContextDialer) TunnelOption {
+	return func(t *tunnel) {
+		t.dialer = d
+	}
+}
+
+// WithTunnelForward how headers are built, see HeaderFromConn.
+func WithTunnelForward(opts ...ForwardOption) TunnelOption {
+	return func(t *tunnel) {
+		t.forward = append(t.forward, opts...)
+	}
+}
+
+// WithTunnelClient options of ClientConn to targets.
+func WithTunnelClient(opts ...ClientOption) TunnelOption {
+	return func(t *tunnel) {
+		t.clientOptions = append(t.clientOptions, opts...)
+	}
+}
+
+// WithTunnelAuth require clients to authenticate with username and password,
+// the username/password method of SOCKS5, or Basic Proxy-Authorization of HTTP CONNECT.
+func WithTunnelAuth(fn func(user, password string) bool) TunnelOption {
+	return func(t *tunnel) {
+		t.auth = fn
+	}
+}
+
+// WithTunnelAllow allow the target only if fn returns true, target is the requested host:port,
+// which is not resolved yet. user is empty if WithTunnelAuth is not set. all targets are allowed by default,
+// the resolved addresses may be checked by Control of a *net.Dialer set by WithTunnelDialer.
+func WithTunnelAllow(fn func(user, target string) bool) TunnelOption {
+	return func(t *tunnel) {
+		t.allow = fn
+	}
+}
+
+// WithTunnelUserTLVs add TLVs of the authenticated user to headers, pp2 only.
+// user is empty if WithTunnelAuth is not set.
+func WithTunnelUserTLVs(fn func(user string) TLVs) TunnelOption {
+	return func(t *tunnel) {
+		t.userTLVs = fn
+	}
+}
+
+// WithTunnelHandshakeTimeout limit the time from accepting a client to the tunnel established,
+// such as the SOCKS5 negotiation and dialing the target. 30 seconds by default, zero means no timeout.
+func WithTunnelHandshakeTimeout(d time.Duration) TunnelOption {
+	return func(t *tunnel) {
+		t.handshakeTimeout = d
+	}
+}
+
+// tunnel dial targets on behalf of clients, and send PROXY headers of the clients to them.
+type tunnel struct {
+	dialer        ContextDialer
+	forward       []ForwardOption
+	clientOptions []ClientOption
+	auth          func(user, password string) bool
+	allow         func(user, target string) bool
+	userTLVs      func(user string) TLVs
+
+	handshakeTimeout time.Duration
+}
+
+func newTunnel(opts ...TunnelOption) tunnel {
+	t := tunnel{handshakeTimeout: defaultTunnelHandshakeTimeout}
+	for _, o := range opts {
+		o(&t)
+	}
+	return t
+}
+
+// allowed true if the user is allowed to reach the target.
+func (t *tunnel) allowed(user, target string) bool {
+	return t.allow == nil || t.allow(user, target)
+}
+
+// handshakeDeadline set the read deadline of establishing the tunnel on the client, and bound ctx by it,
+// replies of failures are still written after it. the deadline must be cleared once the tunnel is established.
+func (t *tunnel) handshakeDeadline(ctx context.Context, client net.Conn) (context.Context, context.CancelFunc) {
+	if t.handshakeTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	deadline := time.Now().Add(t.handshakeTimeout)
+	client.SetReadDeadline(deadline)
+	return context.WithDeadline(ctx, deadline)
+}
+
+// dial dial the target with Dialer, the header is built from the client, whose PROXY header
+// is carried over if it is, or wraps, a *Conn. the destination is the dialed address.
+func (t *tunnel) dial(ctx context.Context, client net.Conn, user, target string) (net.Conn, error) {
+	var upstream *Header
+	if pc := findConn(client); pc != nil {
+		if err := pc.readHeader(); err != nil {
+			return nil, err
+		}
+		upstream = pc.Header()
+	}
+	h, err := forwardHeader(client.RemoteAddr(), nil, upstream, t.forward...)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version == Version2 && t.userTLVs != nil {
+		h.TLVs = append(h.TLVs, t.userTLVs(user)...)
+	}
+
+	d := &Dialer{Dialer: t.dialer, Options: t.clientOptions}
+	return d.DialContext(ContextWithHeader(ctx, h), "tcp", target)
+}
+
+// relay copy between the client and the target until both directions are done, then close both.
+// r reads from the client, it may hold data buffered before the tunnel was established.
+func relay(client net.Conn, r io.Reader, target net.Conn) {
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(target, r)
+		closeWrite(target, client)
+	}()
+	io.Copy(client, target)
+	closeWrite(client, target)
+	<-done
+}
+
+// closeWrite shut down the writing side of dst, both are closed if it is not supported.
+func closeWrite(dst, src net.Conn) {
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return
+	}
+	dst.Close()
+	src.Close()
+}
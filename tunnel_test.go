@@ -0,0 +1,75 @@
+package proxyproto
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testUserTLV = PP2Type(0xE1)
+
+func testUserTLVs(user string) TLVs {
+	return TLVs{NewTLV(testUserTLV, []byte(user))}
+}
+
+// newTunnelBackend serve behind the PROXY protocol, it writes the real client and the user TLV
+// in a line, and then echoes until EOF.
+func newTunnelBackend(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pln := NewListener(ln)
+	t.Cleanup(func() { pln.Close() })
+	go func() {
+		for {
+			conn, err := pln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var user string
+				if h := conn.(*Conn).Header(); h != nil {
+					if tlv, ok := h.TLVs.Find(testUserTLV); ok {
+						user = string(tlv.Value)
+					}
+				}
+				fmt.Fprintf(conn, "%s %s\n", conn.RemoteAddr(), user)
+				io.Copy(conn, conn)
+				conn.(*Conn).CloseWrite()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testAllow deny the user alice to reach 192.0.2.1:80.
+func testAllow(user, target string) bool {
+	return user != "alice" || target != "192.0.2.1:80"
+}
+
+// closedAddr an address nobody listens on.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// checkTunnel check the backend sees the client and the user, and data is relayed until EOF.
+func checkTunnel(t *testing.T, conn net.Conn, r *bufio.Reader, src, user string) {
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, src+" "+user+"\n", line)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(rest))
+}
@@ -5,11 +5,21 @@ import (
 	"math"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
-func parseAndValidateIP(srcIpStr, dstIpStr string, af AddressFamily) (net.IP, net.IP, error) {
+func parseAndValidateIP(srcIpStr, dstIpStr string, af AddressFamily, profile ParseProfile) (net.IP, net.IP, error) {
+	if profile == ProfileStrict {
+		if err := validateV1IPNotation(srcIpStr, af); err != nil {
+			return nil, nil, errors.Wrap(err, "source IP")
+		}
+		if err := validateV1IPNotation(dstIpStr, af); err != nil {
+			return nil, nil, errors.Wrap(err, "destination IP")
+		}
+	}
+
 	var srcIP = net.ParseIP(srcIpStr)
 	if err := validateIP(srcIP, af); err != nil {
 		return nil, nil, errors.Wrap(err, "source IP")
@@ -35,34 +45,53 @@ func validateIP(ip net.IP, af AddressFamily) error {
 	return nil
 }
 
-func parseAndValidatePort(srcPortStr, dstPortStr string) (int, int, error) {
-	srcPort, err := strconv.Atoi(srcPortStr)
+func parseAndValidatePort(srcPortStr, dstPortStr string, profile ParseProfile) (int, int, error) {
+	srcPort, err := parsePort(srcPortStr, profile)
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "source port")
 	}
-	if err := validatePort(srcPort); err != nil {
-		return 0, 0, errors.Wrap(err, "source port")
-	}
 
-	dstPort, err := strconv.Atoi(dstPortStr)
+	dstPort, err := parsePort(dstPortStr, profile)
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "destination port")
 	}
-	if err := validatePort(dstPort); err != nil {
-		return 0, 0, errors.Wrap(err, "destination port")
-	}
 	return srcPort, dstPort, nil
 }
 
+// parsePort parse decimal port of pp1, leading zeros are rejected by the strict profile.
+func parsePort(s string, profile ParseProfile) (int, error) {
+	if s == "" {
+		return 0, errors.New("invalid port")
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, errors.New("invalid port")
+		}
+	}
+	if profile == ProfileStrict && len(s) > 1 && s[0] == '0' {
+		return 0, errors.New("leading zeros in port")
+	}
+
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.New("invalid port")
+	}
+	if err := validatePort(port); err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+// validatePort port must be in the range 0..65535 inclusive.
 func validatePort(port int) error {
-	if port <= 0 || port >= math.MaxUint16 {
+	if port < 0 || port > math.MaxUint16 {
 		return errors.New("invalid port")
 	}
 	return nil
 }
 
-// guessAndParseAddrs guess the addresses what are type, and parse them.
-func guessAndParseAddrs(srcAddr, dstAddr net.Addr) (*bytes.Buffer, uint16, AddressFamily, TransportProtocol) {
+// appendV2Addrs guess the addresses what are type, and append them to b as the pp2 address block.
+func appendV2Addrs(b []byte, srcAddr, dstAddr net.Addr) ([]byte, AddressFamily, TransportProtocol, error) {
 	var srcIP, dstIP net.IP
 	var srcPort, dstPort int
 	var tp TransportProtocol
@@ -71,7 +100,7 @@ func guessAndParseAddrs(srcAddr, dstAddr net.Addr) (*bytes.Buffer, uint16, Addre
 	case *net.TCPAddr:
 		dstType, ok := dstAddr.(*net.TCPAddr)
 		if !ok {
-			return nil, 0, 0, 0
+			return nil, 0, 0, ErrInvalidAddress
 		}
 		srcIP, dstIP, srcPort, dstPort = srcType.IP, dstType.IP, srcType.Port, dstType.Port
 		tp = SOCK_STREAM
@@ -79,7 +108,7 @@ func guessAndParseAddrs(srcAddr, dstAddr net.Addr) (*bytes.Buffer, uint16, Addre
 	case *net.UDPAddr:
 		dstType, ok := dstAddr.(*net.UDPAddr)
 		if !ok {
-			return nil, 0, 0, 0
+			return nil, 0, 0, ErrInvalidAddress
 		}
 		srcIP, dstIP, srcPort, dstPort = srcType.IP, dstType.IP, srcType.Port, dstType.Port
 		tp = SOCK_DGRAM
@@ -87,34 +116,44 @@ func guessAndParseAddrs(srcAddr, dstAddr net.Addr) (*bytes.Buffer, uint16, Addre
 	case *net.UnixAddr:
 		dstType, ok := dstAddr.(*net.UnixAddr)
 		if !ok {
-			return nil, 0, 0, 0
+			return nil, 0, 0, ErrInvalidAddress
+		}
+		tp = unixTransportProtocol(srcType.Net)
+		if tp == SOCK_UNSPEC {
+			return nil, 0, 0, ErrUnknownTranProtocol
 		}
-		if srcType.Net == "unix" {
-			tp = SOCK_STREAM
-		} else if srcType.Net == "unixgram" {
-			tp = SOCK_DGRAM
+		b, err := appendUnixName(b, srcType.Name)
+		if err != nil {
+			return nil, 0, 0, errors.Wrap(err, "source")
 		}
-		var payloadBuf = bytes.NewBuffer([]byte(formatUnixName(srcType.Name) + formatUnixName(dstType.Name)))
-		return payloadBuf, addressLengthUnix, AF_UNIX, tp
+		b, err = appendUnixName(b, dstType.Name)
+		if err != nil {
+			return nil, 0, 0, errors.Wrap(err, "destination")
+		}
+		return b, AF_UNIX, tp, nil
+
+	default:
+		return nil, 0, 0, ErrInvalidAddress
 	}
 
 	if len(srcIP) == 0 || len(dstIP) == 0 || validatePort(srcPort) != nil || validatePort(dstPort) != nil {
-		return nil, 0, 0, 0
-	}
-
-	var payloadBuf = &bytes.Buffer{}
-	if len(srcIP.To4()) == net.IPv4len && len(dstIP.To4()) == net.IPv4len {
-		payloadBuf.Write(srcIP.To4())
-		payloadBuf.Write(dstIP.To4())
-		payloadBuf.Write([]byte{byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort)})
-		return payloadBuf, addressLengthIPv4, AF_INET, tp
-	} else if len(srcIP.To16()) == net.IPv6len && len(dstIP.To16()) == net.IPv6len {
-		payloadBuf.Write(srcIP.To16())
-		payloadBuf.Write(dstIP.To16())
-		payloadBuf.Write([]byte{byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort)})
-		return payloadBuf, addressLengthIPv6, AF_INET6, tp
-	}
-	return nil, 0, 0, 0
+		return nil, 0, 0, ErrInvalidAddress
+	}
+
+	var af AddressFamily
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); len(src4) == net.IPv4len && len(dst4) == net.IPv4len {
+		b = append(b, src4...)
+		b = append(b, dst4...)
+		af = AF_INET
+	} else if src16, dst16 := srcIP.To16(), dstIP.To16(); len(src16) == net.IPv6len && len(dst16) == net.IPv6len {
+		b = append(b, src16...)
+		b = append(b, dst16...)
+		af = AF_INET6
+	} else {
+		return nil, 0, 0, ErrInvalidAddress
+	}
+	b = append(b, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	return b, af, tp, nil
 }
 
 func validatePayloadLength(length uint16, af AddressFamily) error {
@@ -135,7 +174,21 @@ func validatePayloadLength(length uint16, af AddressFamily) error {
 	return nil
 }
 
+// unixNameLength length of a unix socket name, the same as sun_path of Linux.
+const unixNameLength = addressLengthUnix / 2
+
+// parseUnixName parse a unix socket name of pp2.
+// the abstract name (Linux) starts with NUL, it is converted to '@' like package net does,
+// and its trailing NULs are dropped because they can not be told from the filler.
 func parseUnixName(name []byte) string {
+	if len(name) > 0 && name[0] == 0 {
+		abstract := bytes.TrimRight(name[1:], "\x00")
+		if len(abstract) == 0 {
+			return "" // unnamed
+		}
+		return "@" + string(abstract)
+	}
+
 	i := bytes.IndexByte(name, 0)
 	if i < 0 {
 		return string(name)
@@ -143,12 +196,36 @@ func parseUnixName(name []byte) string {
 	return string(name[:i])
 }
 
-func formatUnixName(name string) string {
-	half := addressLengthUnix / 2
-	if len(name) >= half {
-		return name[:half]
+// appendUnixName append a unix socket name to b as the fixed 108 bytes of pp2, filled with NULs.
+// the pathname needs a NUL terminator, so it must be shorter than 108 bytes,
+// the abstract name starting with '@' takes the whole 108 bytes at most.
+func appendUnixName(b []byte, name string) ([]byte, error) {
+	var limit = unixNameLength - 1
+	var abstract = strings.HasPrefix(name, "@")
+	if abstract {
+		limit = unixNameLength
+	}
+	if len(name) > limit {
+		return nil, ErrUnixNameTooLong
 	}
 
-	filler := make([]byte, half-len(name))
-	return name + string(filler)
+	var start = len(b)
+	if abstract {
+		b = append(b, 0)
+		name = name[1:]
+	}
+	b = append(b, name...)
+	return append(b, make([]byte, unixNameLength-(len(b)-start))...), nil
+}
+
+// unixTransportProtocol convert network of unix socket to transport protocol.
+// SOCK_SEQPACKET (unixpacket) is connection-oriented, so it is taken as SOCK_STREAM.
+func unixTransportProtocol(network string) TransportProtocol {
+	switch network {
+	case "unix", "unixpacket":
+		return SOCK_STREAM
+	case "unixgram":
+		return SOCK_DGRAM
+	}
+	return SOCK_UNSPEC
 }
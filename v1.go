@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"net"
-	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -23,14 +22,18 @@ var (
 	ErrNotFoundAddressFamily = errors.New("pp1 header not found address family")
 	ErrInvalidAddressFamily  = errors.New("pp1 invalid address family")
 	ErrNotFoundAddressOrPort = errors.New("pp1 header not found address or port")
+
+	ErrInvalidFieldSeparator  = errors.New("pp1 fields must be separated by a single space")
+	ErrUnexpectedField        = errors.New("pp1 header has unexpected fields after the ports")
+	ErrInvalidAddressNotation = errors.New("pp1 address notation does not match the address family")
 )
 
-func readAndParseV1(reader *bufio.Reader) (*Header, error) {
+func readAndParseV1(reader *bufio.Reader, profile ParseProfile) (*Header, error) {
 	raw, err := readV1(reader)
 	if err != nil {
 		return nil, err
 	}
-	return parseV1(raw)
+	return parseV1(raw, profile)
 }
 
 func readV1(reader *bufio.Reader) ([]byte, error) {
@@ -67,8 +70,11 @@ func readV1(reader *bufio.Reader) ([]byte, error) {
 	}
 }
 
-func parseV1(raw []byte) (*Header, error) {
-	fields := strings.Fields(string(bytes.TrimSpace(raw)))
+func parseV1(raw []byte, profile ParseProfile) (*Header, error) {
+	fields, err := splitV1Fields(raw, profile)
+	if err != nil {
+		return nil, err
+	}
 	if len(fields) < 2 {
 		return nil, ErrNotFoundAddressFamily
 	}
@@ -99,12 +105,12 @@ func parseV1(raw []byte) (*Header, error) {
 	header.Command = CMD_PROXY
 	header.TransportProtocol = SOCK_STREAM
 
-	srcIP, dstIP, err := parseAndValidateIP(fields[2], fields[3], af)
+	srcIP, dstIP, err := parseAndValidateIP(fields[2], fields[3], af, profile)
 	if err != nil {
 		return nil, err
 	}
 
-	sourcePort, destPort, err := parseAndValidatePort(fields[4], fields[5])
+	sourcePort, destPort, err := parseAndValidatePort(fields[4], fields[5], profile)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +58,7 @@ func Test_readAndParseV1(t *testing.T) {
 	for _, tt := range readAndParseV1Tests {
 		t.Run(tt.name, func(t *testing.T) {
 			reader := bufio.NewReader(strings.NewReader(tt.raw))
-			got, err := readAndParseV1(reader)
+			got, err := readAndParseV1(reader, ProfileLenient)
 			require.NoError(t, err)
 			require.Equal(t, tt.want, got)
 		})
@@ -147,7 +147,7 @@ func Test_parseV1(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := parseV1(tt.raw)
+			_, err := parseV1(tt.raw, ProfileLenient)
 			require.Error(t, err)
 			require.EqualError(t, err, tt.wantErr.Error())
 		})
@@ -27,26 +27,28 @@ var (
 )
 
 // readAndParseV2 read and parse header of version 2.
-func readAndParseV2(reader *bufio.Reader) (*Header, error) {
-	header, err := readV2(reader)
+func readAndParseV2(reader *bufio.Reader, profile ParseProfile) (*Header, error) {
+	// checksum is computed while the header streams in, in a single pass
+	var digest crc32cDigest
+	header, err := readV2(reader, profile, &digest)
 	if err != nil {
 		return nil, err
 	}
-
 	if err := parseV2(header); err != nil {
 		return nil, err
 	}
+	header.ChecksumPresent, header.ChecksumVerified = digest.result()
 	return header, nil
 }
 
-// readV2 read header of version 2.
-func readV2(reader *bufio.Reader) (*Header, error) {
+// readV2 read header of version 2, and feed the raw header to digest if not nil.
+func readV2(reader *bufio.Reader, profile ParseProfile, digest *crc32cDigest) (*Header, error) {
 	if reader == nil {
 		return nil, errors.New("pp2 reader is nil")
 	}
 
 	var raw = make([]byte, len(v2Signature), len(v2Signature)+4)
-	n, err := reader.Read(raw[:len(v2Signature)])
+	n, err := io.ReadFull(reader, raw[:len(v2Signature)])
 	if err != nil || n < len(v2Signature) || !bytes.Equal(raw, v2Signature) {
 		return nil, ErrNoProxyProtocol
 	}
@@ -72,6 +74,9 @@ func readV2(reader *bufio.Reader) (*Header, error) {
 	if af.String() == Unknown || tp.String() == Unknown {
 		return nil, ErrUnknownAddrFamilyAndTranProtocol
 	}
+	if profile == ProfileStrict && !v2FamilyAndProtocols[afAndTp] {
+		return nil, ErrUnknownAddrFamilyAndTranProtocol
+	}
 
 	// 15~16th bytes: number of following bytes part of the header
 	var payloadLength uint16
@@ -81,44 +86,109 @@ func readV2(reader *bufio.Reader) (*Header, error) {
 
 	raw = append(raw, verAndCmd, afAndTp, byte(payloadLength>>8), byte(payloadLength))
 	header := &Header{Version: Version2, Command: cmd, AddressFamily: af, TransportProtocol: tp, Raw: raw}
-	// command Local
-	if payloadLength == 0 || header.Command == CMD_LOCAL {
+	// the lenient profile takes an empty PROXY payload as LOCAL
+	if profile != ProfileStrict && payloadLength == 0 {
 		header.Command = CMD_LOCAL
+	}
+	// addresses of LOCAL are ignored, but the strict profile still wants them to fit in
+	if header.Command == CMD_PROXY || (profile == ProfileStrict && payloadLength > 0) {
+		if err := validatePayloadLength(payloadLength, af); err != nil {
+			return nil, err
+		}
+	}
+	if payloadLength == 0 {
+		digest.write(raw)
 		return header, nil
 	}
-	if err := validatePayloadLength(payloadLength, af); err != nil {
+
+	// the whole payload is consumed even for LOCAL, so that nothing leaks into the stream
+	header.Raw = make([]byte, len(v2Signature)+4+int(payloadLength))
+	copy(header.Raw, raw)
+	if err := readV2Payload(reader, header.Raw, len(raw)+v2AddressLength(af), digest); err != nil {
 		return nil, err
 	}
+	return header, nil
+}
 
-	var payload = make([]byte, payloadLength)
-	n, err = reader.Read(payload)
-	if err != nil {
-		return nil, err
+// readV2Payload read the payload into raw after the first 16 bytes, and feed raw to digest as it streams in.
+// TLVs starting at tlvOffset are delimited one by one, so that the value of the first PP2_TYPE_CRC32C
+// is hashed as zeros, and the rest is hashed in as few chunks as possible. parseTLVs validates them later.
+func readV2Payload(reader io.Reader, raw []byte, tlvOffset int, digest *crc32cDigest) error {
+	var cursor = len(v2Signature) + 4
+	readFull := func(end int) error {
+		if end > len(raw) {
+			end = len(raw)
+		}
+		if _, err := io.ReadFull(reader, raw[cursor:end]); err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && cursor > len(v2Signature)+4) {
+				return ErrPayloadBytesTooShort
+			}
+			return err
+		}
+		cursor = end
+		return nil
 	}
-	if n != int(payloadLength) {
-		return nil, ErrPayloadBytesTooShort
+
+	// the address block, or the whole payload if TLVs cannot be delimited
+	if tlvOffset < cursor {
+		tlvOffset = len(raw)
+	}
+	if err := readFull(tlvOffset); err != nil {
+		return err
 	}
 
-	header.Raw = make([]byte, 0, len(v2Signature)+4+int(payloadLength))
-	header.Raw = append(header.Raw, raw...)
-	header.Raw = append(header.Raw, payload...)
-	return header, nil
+	var hashed int // raw[:hashed] has been fed to digest
+	for cursor+3 <= len(raw) {
+		if err := readFull(cursor + 3); err != nil {
+			return err
+		}
+		pp2Type := PP2Type(raw[cursor-3])
+		start := cursor
+		if err := readFull(start + int(binary.BigEndian.Uint16(raw[cursor-2:cursor]))); err != nil {
+			return err
+		}
+		if pp2Type == PP2_TYPE_CRC32C && digest != nil && !digest.present {
+			digest.write(raw[hashed:start])
+			digest.writeChecksum(raw[start:cursor])
+			hashed = cursor
+		}
+	}
+	if err := readFull(len(raw)); err != nil {
+		return err
+	}
+	digest.write(raw[hashed:])
+	return nil
 }
 
-// parseV2 parse header with Header
+// parseV2 parse header with Header.
 func parseV2(header *Header) error {
 	if header == nil {
 		return errors.New("pp2 header is nil")
 	}
-	if header.Command == CMD_LOCAL {
-		return nil
+
+	var payload = header.Raw[len(v2Signature)+4:]
+	var err error
+	// receivers must ignore addresses of LOCAL and UNSPEC, but TLVs are still carried,
+	// such as the metadata of health checkers.
+	if header.Command == CMD_LOCAL || header.AddressFamily == AF_UNSPEC {
+		offset := v2AddressLength(header.AddressFamily)
+		if offset < 0 {
+			return ErrUnknownAddrFamilyAndTranProtocol
+		}
+		if len(payload) == 0 {
+			return nil
+		}
+		// TLVs follow the address block, so a payload shorter than it is truncated
+		if len(payload) < offset {
+			return ErrPayloadBytesTooShort
+		}
+		header.TLVs, err = parseTLVs(payload[offset:])
+		return err
 	}
-	if len(header.Raw) <= len(v2Signature)+4 {
+	if len(payload) == 0 {
 		return errors.New("pp2 payload is empty")
 	}
 
-	var payload = header.Raw[len(v2Signature)+4:]
-	var err error
 	var srcAddr, dstAddr net.Addr
 	var rawTLVs []byte
 
@@ -158,6 +228,21 @@ func parseV2(header *Header) error {
 	return nil
 }
 
+// v2AddressLength length of the address block, -1 if address family is unknown.
+func v2AddressLength(af AddressFamily) int {
+	switch af {
+	case AF_UNSPEC:
+		return 0
+	case AF_INET:
+		return addressLengthIPv4
+	case AF_INET6:
+		return addressLengthIPv6
+	case AF_UNIX:
+		return addressLengthUnix
+	}
+	return -1
+}
+
 func parseV2IPv4(payload []byte, tp TransportProtocol) (src, dst net.Addr, err error) {
 	if len(payload) < addressLengthIPv4 {
 		err = ErrPayloadBytesTooShort
@@ -239,7 +324,7 @@ func parseV2Unix(payload []byte, tp TransportProtocol) (src, dst net.Addr, err e
 		network = "unixgram"
 	}
 
-	src = &net.UnixAddr{Net: network, Name: parseUnixName(payload[:108])}
-	dst = &net.UnixAddr{Net: network, Name: parseUnixName(payload[108:addressLengthUnix])}
+	src = &net.UnixAddr{Net: network, Name: parseUnixName(payload[:unixNameLength])}
+	dst = &net.UnixAddr{Net: network, Name: parseUnixName(payload[unixNameLength:addressLengthUnix])}
 	return
 }
@@ -29,6 +29,32 @@ var readAndParseV2Tests = []struct {
 			AddressFamily:     AF_INET,
 			TransportProtocol: SOCK_STREAM,
 		},
+	}, {
+		name: "local-command-tlvs",
+		raw: ("\r\n\r\n\x00\r\nQUIT\n" + // version 2 signature
+			"\x20\x11\x00\x13" + // version 2, local command, IPv4, TCP, payload length of 19
+			"\x7F\x00\x00\x01\x7F\x00\x00\x01" + // source and destination ips are ignored
+			"\x30\x39\xDD\xD5" + // source and destination ports are ignored
+			"\x02\x00\x04peer"), // type:PP2_TYPE_AUTHORITY, length:4, value:peer
+		want: &Header{
+			Version:           Version2,
+			Command:           CMD_LOCAL,
+			AddressFamily:     AF_INET,
+			TransportProtocol: SOCK_STREAM,
+			TLVs:              TLVs{{Type: PP2_TYPE_AUTHORITY, Length: 4, Value: []byte("peer")}},
+		},
+	}, {
+		name: "local-command-unspec-tlvs",
+		raw: ("\r\n\r\n\x00\r\nQUIT\n" + // version 2 signature
+			"\x20\x00\x00\x07" + // version 2, local command, UNSPEC, payload length of 7
+			"\x02\x00\x04peer"), // type:PP2_TYPE_AUTHORITY, length:4, value:peer
+		want: &Header{
+			Version:           Version2,
+			Command:           CMD_LOCAL,
+			AddressFamily:     AF_UNSPEC,
+			TransportProtocol: SOCK_UNSPEC,
+			TLVs:              TLVs{{Type: PP2_TYPE_AUTHORITY, Length: 4, Value: []byte("peer")}},
+		},
 	}, {
 		name: "proxy-command-IPv4",
 		raw: ("\r\n\r\n\x00\r\nQUIT\n" + // version 2 signature
@@ -106,6 +132,8 @@ var readAndParseV2Tests = []struct {
 				{Type: 3, Length: 4, Value: []byte("\x13\x49\xCA\x53")},
 				{Type: 4, Length: 8, Value: []byte("\x00\x00\x00\x00\x00\x00\x00\x00")},
 			},
+			ChecksumPresent:  true,
+			ChecksumVerified: true,
 		},
 	},
 }
@@ -116,7 +144,7 @@ func Test_readAndParseV2(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.want.Raw = []byte(tt.raw)
 			reader := bufio.NewReader(strings.NewReader(tt.raw))
-			got, err := readAndParseV2(reader)
+			got, err := readAndParseV2(reader, ProfileLenient)
 
 			require.NoError(t, err)
 			require.Equal(t, tt.want, got)
@@ -133,10 +161,11 @@ func Test_readAndParseV2(t *testing.T) {
 		})
 
 		var namePrefix = filepath.Join(dir, "sock")
-		var name = formatUnixName(namePrefix)
+		name, err := appendUnixName(nil, namePrefix)
+		require.NoError(t, err)
 		var raw = "\r\n\r\n\x00\r\nQUIT\n" + // version signature
 			"\x21\x31\x00\xD8" + // version 2, proxy, tcp, 216
-			name + name
+			string(name) + string(name)
 
 		var want = &Header{
 			Version:           Version2,
@@ -147,12 +176,41 @@ func Test_readAndParseV2(t *testing.T) {
 			DstAddr:           &net.UnixAddr{Name: namePrefix, Net: "unix"},
 			Raw:               []byte(raw),
 		}
-		gotHeader, err := readAndParseV2(bufio.NewReader(strings.NewReader(raw)))
+		gotHeader, err := readAndParseV2(bufio.NewReader(strings.NewReader(raw)), ProfileLenient)
 		require.NoError(t, err)
 		require.Equal(t, want, gotHeader)
 	})
 }
 
+func Test_unixName(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr error
+	}{
+		{name: "pathname", addr: "/var/run/app.sock"},
+		{name: "abstract", addr: "@app"},
+		{name: "abstract-with-inner-nul", addr: "@app\x00name"},
+		{name: "unnamed", addr: ""},
+		{name: "pathname-max", addr: "/" + strings.Repeat("a", 106)},
+		{name: "pathname-too-long", addr: "/" + strings.Repeat("a", 107), wantErr: ErrUnixNameTooLong},
+		{name: "abstract-max", addr: "@" + strings.Repeat("a", 107)},
+		{name: "abstract-too-long", addr: "@" + strings.Repeat("a", 108), wantErr: ErrUnixNameTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := appendUnixName(nil, tt.addr)
+			if tt.wantErr != nil {
+				require.EqualError(t, err, tt.wantErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, raw, unixNameLength)
+			require.Equal(t, tt.addr, parseUnixName(raw))
+		})
+	}
+}
+
 var readV2Tests = []struct {
 	name    string
 	raw     string
@@ -203,7 +261,7 @@ func Test_readV2(t *testing.T) {
 	for _, tt := range readV2Tests {
 		t.Run(tt.name, func(t *testing.T) {
 			reader := bufio.NewReader(strings.NewReader(tt.raw))
-			_, err := readV2(reader)
+			_, err := readV2(reader, ProfileLenient, nil)
 			require.EqualError(t, err, tt.wantErr.Error())
 		})
 	}
@@ -225,12 +283,37 @@ func Test_parseV2(t *testing.T) {
 		header := &Header{
 			Version:           Version2,
 			Command:           CMD_PROXY,
-			AddressFamily:     AF_UNSPEC,
+			AddressFamily:     AddressFamily(0x4),
 			TransportProtocol: SOCK_STREAM,
-			Raw: []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x01\x00\x0C" +
+			Raw: []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x41\x00\x0C" +
 				"\x7F\x00\x00\x01\x7F\x00\x00\x01\x30\x39\xDD\xD5"),
 		}
 		err := parseV2(header)
 		require.EqualError(t, err, ErrUnknownAddrFamilyAndTranProtocol.Error())
 	})
+	t.Run("local TLVs shorter than addresses", func(t *testing.T) {
+		header := &Header{
+			Version:           Version2,
+			Command:           CMD_LOCAL,
+			AddressFamily:     AF_INET,
+			TransportProtocol: SOCK_STREAM,
+			Raw: []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x11\x00\x07" +
+				"\x02\x00\x04peer"), // TLVs without the address block
+		}
+		err := parseV2(header)
+		require.EqualError(t, err, ErrPayloadBytesTooShort.Error())
+		require.Nil(t, header.TLVs)
+	})
+	t.Run("local addresses without TLVs", func(t *testing.T) {
+		header := &Header{
+			Version:           Version2,
+			Command:           CMD_LOCAL,
+			AddressFamily:     AF_INET,
+			TransportProtocol: SOCK_STREAM,
+			Raw: []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x11\x00\x0C" +
+				"\x7F\x00\x00\x01\x7F\x00\x00\x01\x30\x39\xDD\xD5"),
+		}
+		require.NoError(t, parseV2(header))
+		require.Empty(t, header.TLVs)
+	})
 }